@@ -0,0 +1,408 @@
+// Package cdevents converts Spinnaker webhooks into CDEvents
+// (https://cdevents.dev), the CD Foundation's vocabulary for continuous
+// delivery, encoded as CloudEvents for HTTP in binary or structured mode.
+//
+// Pipelines are converted to pipelinerun events, stages and tasks to taskrun
+// events, and completed deploy stages also to service.deployed events.
+package cdevents
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// SpecVersion is the version of the CDEvents specification events follow
+const SpecVersion = "0.3.0"
+
+// CloudEventsSpecVersion is the version of the CloudEvents specification
+// events are encoded with
+const CloudEventsSpecVersion = "1.0"
+
+// DefaultSource is the source of events when none is given to the converter
+const DefaultSource = "spinnaker"
+
+// The types of the events webhooks are converted to
+const (
+	PipelineRunStarted  = "dev.cdevents.pipelinerun.started.0.1.1"
+	PipelineRunFinished = "dev.cdevents.pipelinerun.finished.0.1.1"
+	TaskRunStarted      = "dev.cdevents.taskrun.started.0.1.1"
+	TaskRunFinished     = "dev.cdevents.taskrun.finished.0.1.1"
+	ServiceDeployed     = "dev.cdevents.service.deployed.0.1.1"
+)
+
+// DefaultDeployStageTypes are the stage types that deploy a service
+var DefaultDeployStageTypes = []string{"deploy", "deployManifest", "createServerGroup"}
+
+// CDEvent is an event of the CDEvents vocabulary
+type CDEvent struct {
+	Context Context `json:"context"`
+	Subject Subject `json:"subject"`
+}
+
+// Context holds the metadata of a CDEvent
+type Context struct {
+	Version   string `json:"version"`
+	ID        string `json:"id"`
+	Source    string `json:"source"`
+	Type      string `json:"type"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Subject is what a CDEvent is about, such as a pipeline run. Its content
+// depends on the type of the event
+type Subject struct {
+	ID      string                 `json:"id"`
+	Source  string                 `json:"source,omitempty"`
+	Type    string                 `json:"type"`
+	Content map[string]interface{} `json:"content"`
+}
+
+// Mode is how a CloudEvent is encoded in an HTTP request
+type Mode string
+
+// The modes of the CloudEvents HTTP binding. Binary mode sends the CDEvent as
+// the body and the CloudEvent attributes as ce- headers, while structured
+// mode sends the whole CloudEvent as the body
+const (
+	Binary     Mode = "binary"
+	Structured Mode = "structured"
+)
+
+// CloudEvent is a CDEvent in a CloudEvents envelope
+type CloudEvent struct {
+	SpecVersion     string   `json:"specversion"`
+	ID              string   `json:"id"`
+	Source          string   `json:"source"`
+	Type            string   `json:"type"`
+	Time            string   `json:"time"`
+	DataContentType string   `json:"datacontenttype"`
+	Data            *CDEvent `json:"data"`
+}
+
+// Encode returns the headers and body of an HTTP request carrying the event
+// in the given mode
+func (e *CloudEvent) Encode(mode Mode) (http.Header, []byte, error) {
+	header := make(http.Header)
+
+	switch mode {
+	case Binary:
+		body, err := json.Marshal(e.Data)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not encode cdevent")
+		}
+		header.Set("Content-Type", e.DataContentType)
+		header.Set("ce-specversion", e.SpecVersion)
+		header.Set("ce-id", e.ID)
+		header.Set("ce-source", e.Source)
+		header.Set("ce-type", e.Type)
+		header.Set("ce-time", e.Time)
+		return header, body, nil
+	case Structured, "":
+		body, err := json.Marshal(e)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not encode cloudevent")
+		}
+		header.Set("Content-Type", "application/cloudevents+json")
+		return header, body, nil
+	default:
+		return nil, nil, errors.Errorf("unknown cloudevents mode %q", mode)
+	}
+}
+
+// Converter converts webhooks into CloudEvents
+type Converter struct {
+	source           string
+	executionURL     string
+	deployStageTypes map[string]bool
+}
+
+// ConverterOption configures optional behavior of a converter
+type ConverterOption func(*Converter)
+
+// WithSource sets the source of the events, a URI reference identifying the
+// Spinnaker instance (DefaultSource by default)
+func WithSource(source string) ConverterOption {
+	return func(c *Converter) {
+		c.source = source
+	}
+}
+
+// WithExecutionURL links pipeline and task runs to the execution in
+// Spinnaker's UI (Deck) located at the given URL
+func WithExecutionURL(deckURL string) ConverterOption {
+	return func(c *Converter) {
+		c.executionURL = strings.TrimRight(deckURL, "/")
+	}
+}
+
+// WithDeployStageTypes sets the stage types that deploy a service
+// (DefaultDeployStageTypes by default)
+func WithDeployStageTypes(stageTypes ...string) ConverterOption {
+	return func(c *Converter) {
+		c.deployStageTypes = make(map[string]bool, len(stageTypes))
+		for _, stageType := range stageTypes {
+			c.deployStageTypes[stageType] = true
+		}
+	}
+}
+
+// NewConverter initializes a converter
+func NewConverter(opts ...ConverterOption) *Converter {
+	c := &Converter{source: DefaultSource}
+	WithDeployStageTypes(DefaultDeployStageTypes...)(c)
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.source == "" {
+		c.source = DefaultSource
+	}
+
+	return c
+}
+
+// Convert returns the events of the given webhook. Webhooks that have no
+// CDEvents equivalent, such as those that aren't sent by Orca, convert to no
+// events
+func (c *Converter) Convert(incoming *types.IncomingWebhook) ([]*CloudEvent, error) {
+	parts := strings.Split(incoming.Details.Type, ":")
+	if len(parts) != 3 || parts[0] != "orca" {
+		return nil, nil
+	}
+	kind, status := parts[1], parts[2]
+
+	finished := status == "complete" || status == "failed"
+	if !finished && status != "starting" {
+		return nil, nil
+	}
+
+	executionID := incoming.Content.ExecutionID
+	if executionID == "" {
+		executionID = incoming.Content.Execution.ID
+	}
+	if executionID == "" {
+		return nil, errors.New("webhook has no execution id")
+	}
+
+	pipelineRun := map[string]interface{}{"id": executionID, "source": c.source}
+
+	var events []*CloudEvent
+	switch kind {
+	case "pipeline":
+		content := map[string]interface{}{
+			"pipelineName": incoming.Content.Execution.Name,
+			"url":          c.url(incoming, executionID),
+		}
+		eventType := PipelineRunStarted
+		if finished {
+			eventType = PipelineRunFinished
+			c.addOutcome(content, kind, incoming, status)
+		}
+		events = append(events, c.event(eventType, incoming, finished, Subject{
+			ID:      executionID,
+			Source:  c.source,
+			Type:    "pipelineRun",
+			Content: content,
+		}))
+	case "stage", "task":
+		stage := incoming.Content.StageDetails()
+		// Stages can share a name, so the subject is identified by the ID of
+		// the stage rather than by the task name
+		taskName, subjectID := stage.Name, executionID+"/"+stage.Key()
+		if kind == "task" {
+			taskName += "/" + incoming.Content.TaskName
+			subjectID += "/" + incoming.Content.TaskName
+		}
+		content := map[string]interface{}{
+			"taskName":    taskName,
+			"url":         c.url(incoming, executionID),
+			"pipelineRun": pipelineRun,
+		}
+		eventType := TaskRunStarted
+		if finished {
+			eventType = TaskRunFinished
+			c.addOutcome(content, kind, incoming, status)
+		}
+		events = append(events, c.event(eventType, incoming, finished, Subject{
+			ID:      subjectID,
+			Source:  c.source,
+			Type:    "taskRun",
+			Content: content,
+		}))
+
+		if kind == "stage" && status == "complete" && c.deployStageTypes[stage.Type] {
+			events = append(events, c.serviceDeployed(incoming))
+		}
+	default:
+		return nil, nil
+	}
+
+	return events, nil
+}
+
+// serviceDeployed returns the service.deployed event of a deploy stage. The
+// service is the application and its environment the account of the stage
+func (c *Converter) serviceDeployed(incoming *types.IncomingWebhook) *CloudEvent {
+	app := incoming.Application()
+
+	environment := incoming.Content.ContextString("account")
+	if environment == "" {
+		environment = incoming.Content.ContextString("credentials")
+	}
+
+	return c.event(ServiceDeployed, incoming, true, Subject{
+		ID:     app,
+		Source: c.source,
+		Type:   "service",
+		Content: map[string]interface{}{
+			"environment": map[string]interface{}{"id": environment, "source": c.source},
+			"artifactId":  artifactID(incoming),
+		},
+	})
+}
+
+// artifactID returns the package URL (https://github.com/package-url/purl-spec)
+// of what the pipeline deployed: the image of a docker trigger, the first
+// artifact of the trigger with a version, or the application at the execution
+func artifactID(incoming *types.IncomingWebhook) string {
+	trigger := incoming.Content.Execution.Trigger
+	if trigger.Repository != "" && trigger.Tag != "" {
+		return "pkg:docker/" + trigger.Repository + "@" + trigger.Tag
+	}
+
+	for _, artifact := range trigger.Artifacts {
+		if artifact.Name != "" && artifact.Version != "" {
+			return "pkg:generic/" + artifact.Name + "@" + artifact.Version
+		}
+	}
+
+	return "pkg:generic/" + incoming.Application() + "@" + incoming.Content.ExecutionID
+}
+
+// addOutcome adds the outcome of a finished run to the content of its event.
+// CDEvents has no outcome for cancelled runs, so they are sent without one
+func (c *Converter) addOutcome(content map[string]interface{}, kind string, incoming *types.IncomingWebhook, status string) {
+	switch {
+	case incoming.Content.Execution.Canceled:
+	case status == "failed":
+		content["outcome"] = "failure"
+		if errs := failureMessages(kind, incoming); len(errs) > 0 {
+			content["errors"] = strings.Join(errs, "\n")
+		}
+	default:
+		content["outcome"] = "success"
+	}
+}
+
+// failureMessages returns the error messages Orca left in the exception of the
+// stage of a stage or task webhook, or of every stage of a pipeline webhook
+func failureMessages(kind string, incoming *types.IncomingWebhook) []string {
+	if kind != "pipeline" {
+		return exceptionMessages(incoming.Content.Context)
+	}
+
+	var messages []string
+	for _, raw := range incoming.Content.Execution.Stages {
+		if stage, ok := raw.(map[string]interface{}); ok {
+			context, _ := stage["context"].(map[string]interface{})
+			messages = append(messages, exceptionMessages(context)...)
+		}
+	}
+
+	return messages
+}
+
+// exceptionMessages returns the messages of the exception of a stage context,
+// such as {"exception": {"details": {"errors": ["..."]}}}
+func exceptionMessages(context map[string]interface{}) []string {
+	exception, _ := context["exception"].(map[string]interface{})
+	details, _ := exception["details"].(map[string]interface{})
+
+	var messages []string
+	if errs, ok := details["errors"].([]interface{}); ok {
+		for _, err := range errs {
+			if message, ok := err.(string); ok && message != "" {
+				messages = append(messages, message)
+			}
+		}
+	}
+	if message, ok := details["error"].(string); ok && message != "" && len(messages) == 0 {
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+// url returns the URL of the execution in Deck, or an empty string when the
+// URL of Deck isn't known
+func (c *Converter) url(incoming *types.IncomingWebhook, executionID string) string {
+	if c.executionURL == "" {
+		return ""
+	}
+
+	return c.executionURL + "/#/applications/" + incoming.Application() + "/executions/details/" + executionID
+}
+
+// event wraps a subject in a CDEvent and a CloudEvent. The ID of the event is
+// derived from its type, subject and time so a webhook delivered twice is
+// converted to the same events
+func (c *Converter) event(eventType string, incoming *types.IncomingWebhook, finished bool, subject Subject) *CloudEvent {
+	timestamp := eventTime(incoming, finished).UTC().Format(time.RFC3339Nano)
+
+	sum := sha256.Sum256([]byte(eventType + "|" + subject.ID + "|" + timestamp))
+	id := hex.EncodeToString(sum[:16])
+
+	return &CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              id,
+		Source:          c.source,
+		Type:            eventType,
+		Time:            timestamp,
+		DataContentType: "application/json",
+		Data: &CDEvent{
+			Context: Context{
+				Version:   SpecVersion,
+				ID:        id,
+				Source:    c.source,
+				Type:      eventType,
+				Timestamp: timestamp,
+			},
+			Subject: subject,
+		},
+	}
+}
+
+// eventTime returns when the run of the webhook started or finished, falling
+// back to when the webhook was created
+func eventTime(incoming *types.IncomingWebhook, finished bool) time.Time {
+	var t time.Time
+	if finished {
+		t = incoming.Content.EndTime.Time
+		if t.IsZero() {
+			t = incoming.Content.Execution.EndTime.Time
+		}
+	} else {
+		t = incoming.Content.StartTime.Time
+		if t.IsZero() {
+			t = incoming.Content.Execution.StartTime.Time
+		}
+	}
+
+	if t.IsZero() {
+		if ms, err := strconv.ParseInt(incoming.Details.Created, 10, 64); err == nil {
+			t = time.Unix(0, ms*int64(time.Millisecond))
+		} else {
+			t = time.Now()
+		}
+	}
+
+	return t
+}
@@ -0,0 +1,222 @@
+package cdevents_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/cdevents"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+func webhook(hookType string) *types.IncomingWebhook {
+	return &types.IncomingWebhook{
+		Details: types.Details{Application: "hcm", Type: hookType},
+		Content: types.Content{
+			ExecutionID: "01C5ZJ",
+			StartTime:   types.Timestamp{Time: time.Unix(1518214000, 0)},
+			EndTime:     types.Timestamp{Time: time.Unix(1518214010, 0)},
+			Execution: types.Execution{
+				Name:   "Deploy to prod",
+				Status: "TERMINAL",
+				Trigger: types.Trigger{
+					Repository: "registry.example.com/hcm",
+					Tag:        "1.2.3",
+				},
+			},
+			Context: map[string]interface{}{
+				"account":      "prod",
+				"stageDetails": map[string]interface{}{"name": "Deploy", "type": "deploy"},
+			},
+			TaskName: "waitForUpInstances",
+		},
+	}
+}
+
+func TestConvertPipelines(t *testing.T) {
+	c := cdevents.NewConverter(cdevents.WithSource("/spinnaker/prod"), cdevents.WithExecutionURL("https://spinnaker.example.com/"))
+
+	events, err := c.Convert(webhook("orca:pipeline:starting"))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	started := events[0]
+	assert.Equal(t, cdevents.PipelineRunStarted, started.Type)
+	assert.Equal(t, "/spinnaker/prod", started.Source)
+	assert.Equal(t, "2018-02-09T22:06:40Z", started.Time)
+	assert.Equal(t, started.ID, started.Data.Context.ID)
+	assert.Equal(t, cdevents.SpecVersion, started.Data.Context.Version)
+	assert.Equal(t, "pipelineRun", started.Data.Subject.Type)
+	assert.Equal(t, "01C5ZJ", started.Data.Subject.ID)
+	assert.Equal(t, "Deploy to prod", started.Data.Subject.Content["pipelineName"])
+	assert.Equal(t, "https://spinnaker.example.com/#/applications/hcm/executions/details/01C5ZJ", started.Data.Subject.Content["url"])
+
+	events, err = c.Convert(webhook("orca:pipeline:failed"))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	finished := events[0]
+	assert.Equal(t, cdevents.PipelineRunFinished, finished.Type)
+	assert.Equal(t, "2018-02-09T22:06:50Z", finished.Time)
+	assert.Equal(t, "failure", finished.Data.Subject.Content["outcome"])
+	assert.NotContains(t, finished.Data.Subject.Content, "errors", "the status of the execution is not an error")
+	assert.NotEqual(t, started.ID, finished.ID)
+
+	again, err := c.Convert(webhook("orca:pipeline:failed"))
+	require.NoError(t, err)
+	assert.Equal(t, finished.ID, again[0].ID, "the same webhook should convert to the same event")
+	cancelled := webhook("orca:pipeline:failed")
+	cancelled.Content.Execution.Canceled = true
+	events, err = c.Convert(cancelled)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.NotContains(t, events[0].Data.Subject.Content, "outcome", "cdevents has no outcome for cancelled runs")
+}
+
+func TestConvertStagesAndTasks(t *testing.T) {
+	c := cdevents.NewConverter()
+
+	events, err := c.Convert(webhook("orca:stage:complete"))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	taskRun := events[0]
+	assert.Equal(t, cdevents.TaskRunFinished, taskRun.Type)
+	assert.Equal(t, cdevents.DefaultSource, taskRun.Source)
+	assert.Equal(t, "taskRun", taskRun.Data.Subject.Type)
+	assert.Equal(t, "01C5ZJ/Deploy", taskRun.Data.Subject.ID)
+	assert.Equal(t, "Deploy", taskRun.Data.Subject.Content["taskName"])
+	assert.Equal(t, "success", taskRun.Data.Subject.Content["outcome"])
+	assert.Equal(t, map[string]interface{}{"id": "01C5ZJ", "source": cdevents.DefaultSource}, taskRun.Data.Subject.Content["pipelineRun"])
+
+	deployed := events[1]
+	assert.Equal(t, cdevents.ServiceDeployed, deployed.Type)
+	assert.Equal(t, "service", deployed.Data.Subject.Type)
+	assert.Equal(t, "hcm", deployed.Data.Subject.ID)
+	assert.Equal(t, "pkg:docker/registry.example.com/hcm@1.2.3", deployed.Data.Subject.Content["artifactId"])
+	assert.Equal(t, map[string]interface{}{"id": "prod", "source": cdevents.DefaultSource}, deployed.Data.Subject.Content["environment"])
+
+	events, err = c.Convert(webhook("orca:task:starting"))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, cdevents.TaskRunStarted, events[0].Type)
+	assert.Equal(t, "Deploy/waitForUpInstances", events[0].Data.Subject.Content["taskName"])
+
+	c = cdevents.NewConverter(cdevents.WithDeployStageTypes("deployManifest"))
+	events, err = c.Convert(webhook("orca:stage:complete"))
+	require.NoError(t, err)
+	assert.Len(t, events, 1, "only deploy stages should report deployments")
+}
+
+func TestConvertReportsErrorsOfFailures(t *testing.T) {
+	c := cdevents.NewConverter()
+	exception := map[string]interface{}{
+		"details": map[string]interface{}{
+			"error":  "Unexpected Task Failure",
+			"errors": []interface{}{"Insufficient quota", "Timed out"},
+		},
+	}
+
+	stageFailed := webhook("orca:stage:failed")
+	stageFailed.Content.Context["exception"] = exception
+	events, err := c.Convert(stageFailed)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "Insufficient quota\nTimed out", events[0].Data.Subject.Content["errors"])
+
+	pipelineFailed := webhook("orca:pipeline:failed")
+	pipelineFailed.Content.Execution.Stages = []interface{}{
+		map[string]interface{}{"name": "Bake", "context": map[string]interface{}{}},
+		map[string]interface{}{"name": "Deploy", "context": map[string]interface{}{
+			"exception": map[string]interface{}{"details": map[string]interface{}{"error": "Unexpected Task Failure"}},
+		}},
+	}
+	events, err = c.Convert(pipelineFailed)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "Unexpected Task Failure", events[0].Data.Subject.Content["errors"])
+}
+
+func TestConvertSeparatesStagesWithTheSameName(t *testing.T) {
+	c := cdevents.NewConverter()
+
+	var ids []string
+	for i, id := range []string{"stage-1", "stage-2"} {
+		incoming := webhook("orca:task:complete")
+		incoming.Content.Execution.Stages = []interface{}{
+			map[string]interface{}{"id": "stage-1", "name": "Deploy", "startTime": float64(1518214000000)},
+			map[string]interface{}{"id": "stage-2", "name": "Deploy", "startTime": float64(1518214100000)},
+		}
+		incoming.Content.Context["stageDetails"] = map[string]interface{}{
+			"name":      "Deploy",
+			"startTime": 1518214000000 + i*100000,
+		}
+
+		events, err := c.Convert(incoming)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "01C5ZJ/"+id+"/waitForUpInstances", events[0].Data.Subject.ID)
+		assert.Equal(t, "Deploy/waitForUpInstances", events[0].Data.Subject.Content["taskName"])
+		ids = append(ids, events[0].ID)
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+}
+
+func TestConvertIgnoresOtherWebhooks(t *testing.T) {
+	c := cdevents.NewConverter()
+
+	for _, hookType := range []string{"git:push", "orca:pipeline:paused", "orca:orchestration:complete"} {
+		events, err := c.Convert(webhook(hookType))
+		require.NoError(t, err)
+		assert.Empty(t, events, hookType)
+	}
+
+	incoming := webhook("orca:pipeline:complete")
+	incoming.Content.ExecutionID = ""
+	_, err := c.Convert(incoming)
+	assert.Error(t, err)
+}
+
+func TestEncode(t *testing.T) {
+	events, err := cdevents.NewConverter().Convert(webhook("orca:pipeline:complete"))
+	require.NoError(t, err)
+	event := events[0]
+
+	t.Run("Given binary mode", func(t *testing.T) {
+		header, body, err := event.Encode(cdevents.Binary)
+		require.NoError(t, err)
+
+		assert.Equal(t, "application/json", header.Get("Content-Type"))
+		assert.Equal(t, "1.0", header.Get("ce-specversion"))
+		assert.Equal(t, event.ID, header.Get("ce-id"))
+		assert.Equal(t, cdevents.DefaultSource, header.Get("ce-source"))
+		assert.Equal(t, cdevents.PipelineRunFinished, header.Get("ce-type"))
+		assert.Equal(t, event.Time, header.Get("ce-time"))
+
+		var cdevent cdevents.CDEvent
+		require.NoError(t, json.Unmarshal(body, &cdevent))
+		assert.Equal(t, *event.Data, cdevent)
+	})
+
+	t.Run("Given structured mode", func(t *testing.T) {
+		header, body, err := event.Encode(cdevents.Structured)
+		require.NoError(t, err)
+
+		assert.Equal(t, "application/cloudevents+json", header.Get("Content-Type"))
+
+		var decoded map[string]interface{}
+		require.NoError(t, json.Unmarshal(body, &decoded))
+		assert.Equal(t, "1.0", decoded["specversion"])
+		assert.Equal(t, cdevents.PipelineRunFinished, decoded["type"])
+		assert.Equal(t, "application/json", decoded["datacontenttype"])
+		assert.Contains(t, decoded["data"], "subject")
+	})
+
+	t.Run("Given an unknown mode", func(t *testing.T) {
+		_, _, err := event.Encode("nope")
+		assert.Error(t, err)
+	})
+}
@@ -1,21 +1,41 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	dogstatsd "github.com/DataDog/datadog-go/statsd"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	datadog "gopkg.in/zorkian/go-datadog-api.v2"
 
+	"github.com/DataDog/spinnaker-datadog-bridge/cdevents"
+	"github.com/DataDog/spinnaker-datadog-bridge/forward"
+	"github.com/DataDog/spinnaker-datadog-bridge/otlp"
 	"github.com/DataDog/spinnaker-datadog-bridge/server"
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+// These are set at build time with -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 func main() {
 	app := cli.NewApp()
 	app.Name = "spinnaker-dd-bridge"
+	app.Version = version
 	app.Action = serverAction
 	app.Authors = []cli.Author{
 		{
@@ -35,17 +55,230 @@ func main() {
 			Usage:  "your datadog app key (Found at https://app.datadoghq.com/account/settings#api)",
 			EnvVar: "DATADOG_APP_KEY",
 		},
+		cli.StringFlag{
+			Name:   "datadog-api-key-file",
+			Usage:  "A file to read your datadog api key from, such as a Kubernetes secret mount. It is re-read when it changes",
+			EnvVar: "DATADOG_API_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "datadog-app-key-file",
+			Usage:  "A file to read your datadog app key from, such as a Kubernetes secret mount. It is re-read when it changes",
+			EnvVar: "DATADOG_APP_KEY_FILE",
+		},
+		cli.DurationFlag{
+			Name:   "datadog-key-refresh",
+			Usage:  "How often key files are checked for rotated keys",
+			EnvVar: "DATADOG_KEY_REFRESH",
+			Value:  spinnakerdatadog.DefaultKeyRefresh,
+		},
+		cli.StringFlag{
+			Name:   "datadog-site",
+			Usage:  "The Datadog site to send to, such as datadoghq.eu or us5.datadoghq.com",
+			EnvVar: "DATADOG_SITE",
+			Value:  spinnakerdatadog.DefaultSite,
+		},
+		cli.StringFlag{
+			Name:   "datadog-api-url",
+			Usage:  "The base URL of the Datadog API, overriding the one of --datadog-site",
+			EnvVar: "DATADOG_API_URL,DATADOG_HOST",
+		},
+		cli.StringFlag{
+			Name:   "datadog-proxy-url",
+			Usage:  "The proxy requests to Datadog go through (HTTPS_PROXY is used otherwise)",
+			EnvVar: "DATADOG_PROXY_URL",
+		},
+		cli.StringFlag{
+			Name:   "datadog-ca-bundle",
+			Usage:  "A PEM file of certificates to trust, along with the system's, when connecting to Datadog",
+			EnvVar: "DATADOG_CA_BUNDLE",
+		},
+		cli.StringFlag{
+			Name:   "routes",
+			Usage:  "Send the webhooks selected by the routes in this file to other Datadog orgs",
+			EnvVar: "ROUTES",
+		},
 		cli.StringFlag{
 			Name:   "event-templates",
 			Usage:  "The file where your event templates are located for Spinnaker events",
 			EnvVar: "EVENT_TEMPLATES",
 		},
+		cli.StringFlag{
+			Name:   "service-tags",
+			Usage:  "The file where the mapping from Spinnaker fields to the service, env and version tags is located",
+			EnvVar: "SERVICE_TAGS",
+		},
+		cli.BoolFlag{
+			Name:   "normalize-tags",
+			Usage:  "Rewrite tags to follow Datadog's tag rules and drop tags with empty values",
+			EnvVar: "NORMALIZE_TAGS",
+		},
+		cli.StringSliceFlag{
+			Name:   "tag-key-allowlist",
+			Usage:  "Only send tags with these keys when normalizing tags (may be repeated)",
+			EnvVar: "TAG_KEY_ALLOWLIST",
+		},
+		cli.StringFlag{
+			Name:   "statsd-addr",
+			Usage:  "The address of the DogStatsD agent metrics are sent to",
+			EnvVar: "STATSD_ADDR",
+			Value:  spinnakerdatadog.DefaultStatsdAddr,
+		},
+		cli.BoolFlag{
+			Name:   "self-telemetry",
+			Usage:  "Report the health of the bridge itself to DogStatsD",
+			EnvVar: "SELF_TELEMETRY",
+		},
+		cli.StringFlag{
+			Name:   "self-telemetry-namespace",
+			Usage:  "The namespace of the metrics about the bridge itself sent to DogStatsD",
+			EnvVar: "SELF_TELEMETRY_NAMESPACE",
+			Value:  telemetry.DefaultStatsdNamespace,
+		},
+		cli.StringFlag{
+			Name:   "metric-tag-policy",
+			Usage:  "The file where the allowed tags and their maximum number of values per metric are located",
+			EnvVar: "METRIC_TAG_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "gate-url",
+			Usage:  "The base URL of Spinnaker's Gate API used to enrich events with application and pipeline configuration",
+			EnvVar: "GATE_URL",
+		},
+		cli.DurationFlag{
+			Name:   "gate-cache-ttl",
+			Usage:  "How long application and pipeline configuration from Gate is cached",
+			EnvVar: "GATE_CACHE_TTL",
+			Value:  spinnaker.DefaultEnrichmentTTL,
+		},
+		cli.DurationFlag{
+			Name:   "gate-failure-ttl",
+			Usage:  "How long a failed lookup from Gate is cached before Gate is called again",
+			EnvVar: "GATE_FAILURE_TTL",
+			Value:  spinnaker.DefaultEnrichmentFailureTTL,
+		},
+		cli.BoolFlag{
+			Name:   "ci-visibility",
+			Usage:  "Send pipeline, stage and task webhooks to Datadog CI Visibility",
+			EnvVar: "CI_VISIBILITY",
+		},
+		cli.StringFlag{
+			Name:   "ci-visibility-url",
+			Usage:  "The base URL of the Datadog API CI Visibility events are sent to (the API of --datadog-site by default)",
+			EnvVar: "CI_VISIBILITY_URL",
+		},
+		cli.BoolFlag{
+			Name:   "logs",
+			Usage:  "Send every webhook to Datadog logs",
+			EnvVar: "LOGS",
+		},
+		cli.StringFlag{
+			Name:   "logs-url",
+			Usage:  "The base URL of the Datadog logs intake logs are sent to (the intake of --datadog-site by default)",
+			EnvVar: "LOGS_URL",
+		},
+		cli.StringSliceFlag{
+			Name:   "logs-redact-keys",
+			Usage:  "Redact the values of webhook keys containing this string (case insensitive) before they are logged",
+			EnvVar: "LOGS_REDACT_KEYS",
+		},
+		cli.StringFlag{
+			Name:   "forward-config",
+			Usage:  "Forward webhooks to the destinations in this file",
+			EnvVar: "FORWARD_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "dora-config",
+			Usage:  "Report the pipelines selected in this file to Datadog DORA metrics as deployments",
+			EnvVar: "DORA_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "dora-url",
+			Usage:  "The base URL of the Datadog API DORA deployments are sent to (the API of --datadog-site by default)",
+			EnvVar: "DORA_URL",
+		},
+		cli.StringFlag{
+			Name:   "spinnaker-ui-url",
+			Usage:  "The URL of Spinnaker's UI (Deck), used to link to executions",
+			EnvVar: "SPINNAKER_UI_URL",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			Usage:  "Export pipeline executions as traces to this OTLP/HTTP endpoint (http://localhost:4318 for example)",
+			EnvVar: "OTLP_ENDPOINT",
+		},
+		cli.StringSliceFlag{
+			Name:   "otlp-headers",
+			Usage:  "Add a header to OTLP export requests, for example X-Api-Key=secret (may be repeated)",
+			EnvVar: "OTLP_HEADERS",
+		},
+		cli.StringFlag{
+			Name:   "otlp-service-name",
+			Usage:  "The service.name of exported traces",
+			EnvVar: "OTLP_SERVICE_NAME",
+			Value:  otlp.DefaultServiceName,
+		},
 		cli.StringFlag{
 			Name:   "addr",
 			Usage:  "The address the server listens on",
 			EnvVar: "ADDR",
 			Value:  ":3000",
 		},
+		cli.DurationFlag{
+			Name:   "handler-timeout",
+			Usage:  "How long a handler may run before it is cancelled",
+			EnvVar: "HANDLER_TIMEOUT",
+			Value:  spinnaker.DefaultHandlerTimeout,
+		},
+		cli.Int64Flag{
+			Name:   "max-webhook-size",
+			Usage:  "The largest webhook body in bytes that is accepted, larger webhooks are rejected with a 413",
+			EnvVar: "MAX_WEBHOOK_SIZE",
+			Value:  spinnaker.DefaultMaxWebhookSize,
+		},
+		cli.StringSliceFlag{
+			Name:   "handler-timeouts",
+			Usage:  "Override the timeout of a handler by name, for example DatadogEventHandler=5s, or for one hook type, for example orca:stage:complete/DatadogEventHandler=5s (may be repeated)",
+			EnvVar: "HANDLER_TIMEOUTS",
+		},
+		cli.IntFlag{
+			Name:   "handler-panic-limit",
+			Usage:  "Disable a handler once it panics this many times within --handler-panic-window (0 never disables handlers)",
+			EnvVar: "HANDLER_PANIC_LIMIT",
+		},
+		cli.DurationFlag{
+			Name:   "handler-panic-window",
+			Usage:  "The window in which handler panics are counted towards --handler-panic-limit",
+			EnvVar: "HANDLER_PANIC_WINDOW",
+			Value:  10 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "dedup-ttl",
+			Usage:  "Drop webhooks that were already dispatched within this window (0 disables deduplication)",
+			EnvVar: "DEDUP_TTL",
+		},
+		cli.IntFlag{
+			Name:   "dedup-max-entries",
+			Usage:  "How many webhooks are remembered for deduplication",
+			EnvVar: "DEDUP_MAX_ENTRIES",
+			Value:  spinnaker.DefaultDedupMaxEntries,
+		},
+		cli.IntFlag{
+			Name:   "max-in-flight",
+			Usage:  "How many handlers may run at once before the bridge reports itself as not ready",
+			EnvVar: "MAX_IN_FLIGHT",
+			Value:  100,
+		},
+		cli.BoolFlag{
+			Name:   "validate-api-key",
+			Usage:  "Validate the Datadog API key as part of the readiness check",
+			EnvVar: "VALIDATE_API_KEY",
+		},
+		cli.DurationFlag{
+			Name:   "drain-timeout",
+			Usage:  "How long to wait for in-flight webhooks to be handled when shutting down",
+			EnvVar: "DRAIN_TIMEOUT",
+			Value:  30 * time.Second,
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Turn on DEBUG level logging",
@@ -59,9 +292,110 @@ func main() {
 }
 
 func serverAction(c *cli.Context) error {
-	ddClient := datadog.NewClient(c.String("datadog-api-key"), c.String("datadog-app-key"))
-	dispatcher := spinnaker.NewDispatcher()
-	spout, err := spinnakerdatadog.NewSpout(ddClient, c.String("event-templates"))
+	httpClient, err := spinnakerdatadog.NewHTTPClient(c.String("datadog-proxy-url"), c.String("datadog-ca-bundle"))
+	if err != nil {
+		return err
+	}
+
+	credentials, err := defaultCredentials(c)
+	if err != nil {
+		return err
+	}
+	defer credentials.Close()
+
+	statsd, err := dogstatsd.New(c.String("statsd-addr"))
+	if err != nil {
+		return errors.Wrap(err, "could not open connection to dogstatsd")
+	}
+
+	metrics := telemetry.NewPrometheus()
+	var recorder telemetry.Recorder = metrics
+	if c.Bool("self-telemetry") {
+		recorder = telemetry.Multi{metrics, telemetry.NewStatsd(statsd, c.String("self-telemetry-namespace"))}
+	}
+
+	dispatcherOpts, err := dispatcherOptions(c)
+	if err != nil {
+		return err
+	}
+	dispatcher := spinnaker.NewDispatcher(append(dispatcherOpts, spinnaker.WithRecorder(recorder))...)
+
+	opts := []spinnakerdatadog.SpoutOption{
+		spinnakerdatadog.WithStatsd(statsd),
+		spinnakerdatadog.WithRecorder(recorder),
+	}
+	if gateURL := c.String("gate-url"); gateURL != "" {
+		opts = append(opts, spinnakerdatadog.WithEnricher(spinnaker.NewEnricher(gateURL, c.Duration("gate-cache-ttl"),
+			spinnaker.WithFailureTTL(c.Duration("gate-failure-ttl")),
+		)))
+	}
+
+	if serviceTagsFile := c.String("service-tags"); serviceTagsFile != "" {
+		serviceTags, err := spinnakerdatadog.LoadServiceTags(serviceTagsFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, spinnakerdatadog.WithServiceTags(serviceTags))
+	}
+
+	if policyFile := c.String("metric-tag-policy"); policyFile != "" {
+		policy, err := spinnakerdatadog.LoadMetricTagPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, spinnakerdatadog.WithMetricTagPolicy(policy))
+	}
+
+	if c.Bool("normalize-tags") {
+		opts = append(opts, spinnakerdatadog.WithTagNormalizer(spinnakerdatadog.NewTagNormalizer(c.StringSlice("tag-key-allowlist"))))
+	} else if len(c.StringSlice("tag-key-allowlist")) > 0 {
+		return errors.New("--tag-key-allowlist requires --normalize-tags")
+	}
+
+	var doraConfig *spinnakerdatadog.DORAConfig
+	if doraFile := c.String("dora-config"); doraFile != "" {
+		doraConfig, err = spinnakerdatadog.LoadDORAConfig(doraFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Routes are only added to the default spout
+	var routeOpts []spinnakerdatadog.SpoutOption
+	if routesFile := c.String("routes"); routesFile != "" {
+		routes, err := spinnakerdatadog.LoadRoutes(routesFile)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes.Routes {
+			org, err := routeOrg(c, route)
+			if err != nil {
+				return err
+			}
+			defer org.credentials.Close()
+			templates := route.EventTemplates
+			if templates == "" {
+				templates = c.String("event-templates")
+			}
+			routeSpout, err := newSpout(c, org, templates, doraConfig, httpClient, recorder, opts)
+			if err != nil {
+				return errors.Wrapf(err, "could not create spout of route %s", route.Name)
+			}
+			routeOpts = append(routeOpts, spinnakerdatadog.WithRoute(route, routeSpout))
+		}
+	}
+
+	logsURL := c.String("logs-url")
+	if logsURL == "" {
+		logsURL = spinnakerdatadog.LogsURL(c.String("datadog-site"))
+	}
+	spout, err := newSpout(c, datadogOrg{
+		credentials:     credentials,
+		apiURL:          datadogAPIURL(c, ""),
+		ciVisibilityURL: datadogAPIURL(c, "ci-visibility-url"),
+		doraURL:         datadogAPIURL(c, "dora-url"),
+		logsURL:         logsURL,
+	}, c.String("event-templates"), doraConfig, httpClient, recorder, append(opts, routeOpts...))
 	if err != nil {
 		return err
 	}
@@ -72,5 +406,289 @@ func serverAction(c *cli.Context) error {
 
 	spout.AttachToDispatcher(dispatcher)
 
-	return server.New(c.String("addr"), dispatcher).Start()
+	if forwardFile := c.String("forward-config"); forwardFile != "" {
+		config, err := forward.LoadConfig(forwardFile)
+		if err != nil {
+			return err
+		}
+		var forwarderOpts []forward.ForwarderOption
+		if deckURL := c.String("spinnaker-ui-url"); deckURL != "" {
+			forwarderOpts = append(forwarderOpts, forward.WithConverterOptions(cdevents.WithExecutionURL(deckURL)))
+		}
+		for _, dest := range config.Destinations {
+			f := forward.NewForwarder(dest, forwarderOpts...)
+			if err := checkForwardTimeout(dispatcher, dest, f.Name()); err != nil {
+				return err
+			}
+			f.AttachToDispatcher(dispatcher)
+		}
+	}
+
+	if endpoint := c.String("otlp-endpoint"); endpoint != "" {
+		headers, err := parseHeaders(c.StringSlice("otlp-headers"))
+		if err != nil {
+			return err
+		}
+		otlp.NewExporter(endpoint,
+			otlp.WithHeaders(headers),
+			otlp.WithServiceName(c.String("otlp-service-name")),
+		).AttachToDispatcher(dispatcher)
+	}
+
+	srvOpts := append(serverOptions(c, dispatcher, spout), server.WithRecorder(recorder), server.WithMetricsHandler(metrics))
+	srv := server.New(c.String("addr"), dispatcher, srvOpts...)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Start()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		spout.Close()
+		return err
+	case sig := <-signals:
+		logrus.WithField("signal", sig.String()).Info("received signal, draining")
+	}
+
+	return shutdown(c.Duration("drain-timeout"), srv, dispatcher, spout)
+}
+
+// checkForwardTimeout returns an error when the attempts to send to the given
+// destination don't fit in the timeout of its forwarder, which would never get
+// to retry
+func checkForwardTimeout(d *spinnaker.Dispatcher, dest *forward.Destination, name string) error {
+	hookTypes := dest.Filter.HookTypes
+	if len(hookTypes) == 0 {
+		hookTypes = []string{spinnaker.AnyHookType}
+	}
+
+	for _, hookType := range hookTypes {
+		if timeout := d.HandlerTimeout(hookType, name); dest.MaxDuration() > timeout {
+			return errors.Errorf("destination %s can take up to %s to send with retries, more than the %s timeout of %s: lower its timeout or retries, or raise it with --handler-timeouts=%s=<duration>", dest.Name, dest.MaxDuration(), timeout, name, name)
+		}
+	}
+
+	return nil
+}
+
+// dispatcherOptions returns the handler timeouts of the dispatcher
+func dispatcherOptions(c *cli.Context) ([]spinnaker.DispatcherOption, error) {
+	opts := []spinnaker.DispatcherOption{
+		spinnaker.WithHandlerTimeout(c.Duration("handler-timeout")),
+		spinnaker.WithMaxWebhookSize(c.Int64("max-webhook-size")),
+	}
+
+	for _, override := range c.StringSlice("handler-timeouts") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid handler timeout %q, expected Name=duration", override)
+		}
+
+		timeout, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid handler timeout %q", override)
+		}
+		opts = append(opts, spinnaker.WithHandlerTimeoutFor(parts[0], timeout))
+	}
+
+	if ttl := c.Duration("dedup-ttl"); ttl > 0 {
+		opts = append(opts, spinnaker.WithDeduplication(ttl, c.Int("dedup-max-entries")))
+	}
+
+	if limit := c.Int("handler-panic-limit"); limit > 0 {
+		opts = append(opts, spinnaker.WithPanicLimit(limit, c.Duration("handler-panic-window")))
+	}
+
+	return opts, nil
+}
+
+// parseHeaders parses headers given as Name=value
+func parseHeaders(values []string) (map[string]string, error) {
+	headers := make(map[string]string, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid header %q, expected Name=value", value)
+		}
+		headers[parts[0]] = parts[1]
+	}
+
+	return headers, nil
+}
+
+// defaultCredentials returns the keys given by flags, either directly or as
+// files that are re-read when they change
+func defaultCredentials(c *cli.Context) (*spinnakerdatadog.Credentials, error) {
+	opts := []spinnakerdatadog.CredentialsOption{spinnakerdatadog.WithKeyRefresh(c.Duration("datadog-key-refresh"))}
+	if file := c.String("datadog-api-key-file"); file != "" {
+		if c.String("datadog-api-key") != "" {
+			return nil, errors.New("only one of --datadog-api-key and --datadog-api-key-file can be set")
+		}
+		opts = append(opts, spinnakerdatadog.WithAPIKeyFile(file))
+	}
+	if file := c.String("datadog-app-key-file"); file != "" {
+		if c.String("datadog-app-key") != "" {
+			return nil, errors.New("only one of --datadog-app-key and --datadog-app-key-file can be set")
+		}
+		opts = append(opts, spinnakerdatadog.WithAppKeyFile(file))
+	}
+
+	return spinnakerdatadog.NewCredentials(c.String("datadog-api-key"), c.String("datadog-app-key"), opts...)
+}
+
+// datadogOrg is the Datadog org a spout sends to
+type datadogOrg struct {
+	credentials     *spinnakerdatadog.Credentials
+	apiURL          string
+	ciVisibilityURL string
+	doraURL         string
+	logsURL         string
+}
+
+// routeOrg returns the Datadog org of the given route. The site of the route
+// defaults to --datadog-site
+func routeOrg(c *cli.Context, route *spinnakerdatadog.Route) (datadogOrg, error) {
+	credentials, err := route.Credentials(spinnakerdatadog.WithKeyRefresh(c.Duration("datadog-key-refresh")))
+	if err != nil {
+		return datadogOrg{}, err
+	}
+
+	site := route.Site
+	if site == "" {
+		site = c.String("datadog-site")
+	}
+	apiURL := route.APIURL
+	if apiURL == "" {
+		apiURL = spinnakerdatadog.APIURL(site)
+	}
+
+	return datadogOrg{
+		credentials:     credentials,
+		apiURL:          apiURL,
+		ciVisibilityURL: apiURL,
+		doraURL:         apiURL,
+		logsURL:         spinnakerdatadog.LogsURL(site),
+	}, nil
+}
+
+// newSpout builds a spout that sends the events of the given templates to the
+// given org, along with the sinks enabled by flags and the DORA metrics of the
+// given config when not nil. Clients are built without keys since the
+// credentials of the org add them to every request
+func newSpout(c *cli.Context, org datadogOrg, templateFile string, doraConfig *spinnakerdatadog.DORAConfig, httpClient *http.Client, recorder telemetry.Recorder, opts []spinnakerdatadog.SpoutOption) (*spinnakerdatadog.Spout, error) {
+	httpClient = org.credentials.Client(httpClient)
+
+	ddClient := datadog.NewClient("", "")
+	ddClient.SetBaseUrl(org.apiURL)
+
+	// Validating the keys with the Datadog client can't be cancelled, so its
+	// HTTP timeout is the only thing that ends it
+	ddHTTPClient := *httpClient
+	ddHTTPClient.Timeout = c.Duration("handler-timeout")
+	ddClient.HttpClient = &ddHTTPClient
+	ddClient.RetryTimeout = c.Duration("handler-timeout")
+
+	opts = append([]spinnakerdatadog.SpoutOption(nil), opts...)
+
+	if c.Bool("ci-visibility") {
+		var ciOpts []spinnakerdatadog.CIVisibilityOption
+		if deckURL := c.String("spinnaker-ui-url"); deckURL != "" {
+			ciOpts = append(ciOpts, spinnakerdatadog.WithExecutionURL(deckURL))
+		}
+		ciOpts = append(ciOpts,
+			spinnakerdatadog.WithCIVisibilityRecorder(recorder),
+			spinnakerdatadog.WithCIVisibilityHTTPClient(httpClient),
+		)
+		opts = append(opts, spinnakerdatadog.WithCIVisibility(spinnakerdatadog.NewCIVisibilitySink(org.ciVisibilityURL, "", ciOpts...)))
+	}
+
+	if c.Bool("logs") {
+		opts = append(opts, spinnakerdatadog.WithLogs(spinnakerdatadog.NewLogsSink(org.logsURL, "",
+			spinnakerdatadog.WithRedactedKeys(c.StringSlice("logs-redact-keys")...),
+			spinnakerdatadog.WithLogsRecorder(recorder),
+			spinnakerdatadog.WithLogsHTTPClient(httpClient),
+		)))
+	}
+
+	if doraConfig != nil {
+		opts = append(opts, spinnakerdatadog.WithDORA(spinnakerdatadog.NewDORAHandler(org.doraURL, "", doraConfig,
+			spinnakerdatadog.WithDORARecorder(recorder),
+			spinnakerdatadog.WithDORAHTTPClient(httpClient),
+		)))
+	}
+
+	return spinnakerdatadog.NewSpout(ddClient, templateFile, opts...)
+}
+
+// datadogAPIURL returns the value of the given flag, falling back to
+// --datadog-api-url and then to the API of --datadog-site
+func datadogAPIURL(c *cli.Context, flag string) string {
+	if flag != "" && c.String(flag) != "" {
+		return c.String(flag)
+	}
+	if apiURL := c.String("datadog-api-url"); apiURL != "" {
+		return apiURL
+	}
+
+	return spinnakerdatadog.APIURL(c.String("datadog-site"))
+}
+
+// serverOptions returns the build information and readiness checks of the server
+func serverOptions(c *cli.Context, d *spinnaker.Dispatcher, spout *spinnakerdatadog.Spout) []server.Option {
+	maxInFlight := c.Int("max-in-flight")
+
+	opts := []server.Option{
+		server.WithBuildInfo(server.BuildInfo{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
+		}),
+		server.WithReadinessCheck("templates", spout.CompileTemplates),
+		server.WithReadinessCheck("statsd", func() error {
+			return spinnakerdatadog.CheckStatsd(c.String("statsd-addr"))
+		}),
+		server.WithReadinessCheck("dispatcher", func() error {
+			if d.Draining() {
+				return errors.New("draining")
+			}
+			if inFlight := d.InFlight(); inFlight >= maxInFlight {
+				return fmt.Errorf("%d handlers in flight, the maximum is %d", inFlight, maxInFlight)
+			}
+			return nil
+		}),
+	}
+
+	if c.Bool("validate-api-key") {
+		opts = append(opts, server.WithReadinessCheck("datadog_api_key", server.CachedCheck(spout.ValidateAPIKey, time.Minute)))
+	}
+
+	return opts
+}
+
+// shutdown stops the server from accepting webhooks, waits for the handlers
+// that are still running and flushes the metrics that haven't been sent yet.
+// Everything has to finish within the given timeout.
+func shutdown(timeout time.Duration, srv *server.Server, d *spinnaker.Dispatcher, spout *spinnakerdatadog.Spout) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var result error
+	if err := srv.Shutdown(ctx); err != nil {
+		result = errors.Wrap(err, "could not shut down server")
+	}
+
+	if err := d.Drain(ctx); err != nil && result == nil {
+		result = err
+	}
+
+	if err := spout.Close(); err != nil && result == nil {
+		result = err
+	}
+
+	logrus.Info("shutdown complete")
+	return result
 }
@@ -0,0 +1,427 @@
+// Package forward sends webhooks on to other HTTP endpoints, so tools that
+// want Spinnaker events can get them from the bridge rather than from Echo.
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/cdevents"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// Defaults of a destination that doesn't set them. Every attempt and the
+// delays between them fit in the default handler timeout of the dispatcher
+const (
+	DefaultTimeout = 2 * time.Second
+	DefaultRetries = 2
+)
+
+// retryBackoff is how long to wait before the first retry. It doubles with
+// every retry
+var retryBackoff = 500 * time.Millisecond
+
+// Filter selects the webhooks sent to a destination. HookTypes lists the hook
+// types to send, and Application and Pipeline are glob patterns (see
+// path.Match) matched against the application and the pipeline name. Empty
+// fields match everything.
+type Filter struct {
+	HookTypes   []string `json:"hookTypes,omitempty"`
+	Application string   `json:"application,omitempty"`
+	Pipeline    string   `json:"pipeline,omitempty"`
+}
+
+// Destination is an endpoint webhooks are forwarded to. The webhook is sent
+// as Spinnaker sent it unless Body is set, in which case Body is rendered as a
+// template of the webhook and must render to JSON, or Format is "cdevents", in
+// which case it is sent as CDEvents (see package cdevents). Values of Headers
+// may refer to environment variables as $VAR or ${VAR}, so secrets don't have
+// to be written in the file.
+type Destination struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Filter  Filter            `json:"filter,omitempty"`
+
+	Format string `json:"format,omitempty"`
+	// Mode is how CDEvents are encoded, "structured" (the default) or "binary"
+	Mode cdevents.Mode `json:"mode,omitempty"`
+	// Source is the source of CDEvents, cdevents.DefaultSource by default
+	Source string `json:"source,omitempty"`
+
+	// Timeout bounds every attempt to send a webhook, such as "5s". Every
+	// attempt and the delays between them must fit in the handler timeout
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is how many more times a webhook is sent when the destination
+	// can't be reached or answers with a 5xx or 429 status code. It defaults
+	// to DefaultRetries, set it to 0 to never retry
+	Retries *int `json:"retries,omitempty"`
+
+	body    *template.Template
+	timeout time.Duration
+}
+
+// Config lists the destinations webhooks are forwarded to, for example:
+//
+//	destinations:
+//	  - name: release-tracker
+//	    url: https://tracker.example.com/hooks/spinnaker
+//	    headers:
+//	      Authorization: "Bearer ${TRACKER_TOKEN}"
+//	    filter:
+//	      hookTypes: ["orca:pipeline:complete", "orca:pipeline:failed"]
+type Config struct {
+	Destinations []*Destination `json:"destinations"`
+}
+
+// LoadConfig reads the destinations from the given YAML file
+func LoadConfig(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read forward config file")
+	}
+
+	config := new(Config)
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal forward config file")
+	}
+
+	names := make(map[string]bool)
+	for _, dest := range config.Destinations {
+		if dest.Name == "" || dest.URL == "" {
+			return nil, errors.New("every destination needs a name and a url")
+		}
+		if names[dest.Name] {
+			return nil, errors.Errorf("duplicate destination %q", dest.Name)
+		}
+		names[dest.Name] = true
+
+		if err := dest.Compile(); err != nil {
+			return nil, errors.Wrapf(err, "invalid destination %q", dest.Name)
+		}
+	}
+
+	return config, nil
+}
+
+// FormatCDEvents is the format of destinations that receive CDEvents
+const FormatCDEvents = "cdevents"
+
+// Compile parses the body template, timeout and filter patterns of the
+// destination and checks its retries
+func (d *Destination) Compile() error {
+	switch d.Format {
+	case "":
+	case FormatCDEvents:
+		if d.Body != "" {
+			return errors.New("a body can't be sent as cdevents")
+		}
+		if d.Mode != "" && d.Mode != cdevents.Binary && d.Mode != cdevents.Structured {
+			return errors.Errorf("unknown cloudevents mode %q", d.Mode)
+		}
+	default:
+		return errors.Errorf("unknown format %q", d.Format)
+	}
+
+	for _, pattern := range []string{d.Filter.Application, d.Filter.Pipeline} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+	}
+
+	if d.Retries != nil && *d.Retries < 0 {
+		return errors.New("retries can't be negative")
+	}
+
+	d.timeout = DefaultTimeout
+	if d.Timeout != "" {
+		timeout, err := time.ParseDuration(d.Timeout)
+		if err != nil {
+			return errors.Wrap(err, "invalid timeout")
+		}
+		d.timeout = timeout
+	}
+
+	if d.Body != "" {
+		body, err := template.New(d.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(d.Body)
+		if err != nil {
+			return errors.Wrap(err, "could not compile body")
+		}
+		d.body = body
+	}
+
+	return nil
+}
+
+// MaxDuration returns how long sending one request to the destination can
+// take when every attempt times out, including the delays between retries. It
+// must be compiled
+func (d *Destination) MaxDuration() time.Duration {
+	retries := DefaultRetries
+	if d.Retries != nil {
+		retries = *d.Retries
+	}
+
+	total := d.timeout
+	backoff := retryBackoff
+	for i := 0; i < retries; i++ {
+		total += backoff + d.timeout
+		backoff *= 2
+	}
+
+	return total
+}
+
+// toJSON encodes a value for a body template, such as {{ json .Details.Application }}
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Accepts returns whether the filter of the destination selects the webhook
+func (d *Destination) Accepts(incoming *types.IncomingWebhook) bool {
+	if len(d.Filter.HookTypes) > 0 {
+		found := false
+		for _, hookType := range d.Filter.HookTypes {
+			if hookType == incoming.Details.Type {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return spinnaker.MatchGlob(d.Filter.Application, incoming.Application()) &&
+		spinnaker.MatchGlob(d.Filter.Pipeline, incoming.Content.Execution.Name)
+}
+
+// Forwarder is a handler that forwards webhooks to a destination. It is
+// registered for the hook types of the filter of the destination, or for every
+// hook type when the filter has none, whether the webhook has an event
+// template or not.
+type Forwarder struct {
+	dest      *Destination
+	client    *http.Client
+	converter *cdevents.Converter
+}
+
+var (
+	_ spinnaker.Handler        = (*Forwarder)(nil)
+	_ spinnaker.ContextHandler = (*Forwarder)(nil)
+)
+
+// ForwarderOption configures optional behavior of a forwarder
+type ForwarderOption func(*Forwarder)
+
+// WithHTTPClient sends webhooks with the given client
+func WithHTTPClient(c *http.Client) ForwarderOption {
+	return func(f *Forwarder) {
+		f.client = c
+	}
+}
+
+// WithConverterOptions configures how webhooks are converted for destinations
+// that receive CDEvents, such as with cdevents.WithExecutionURL
+func WithConverterOptions(opts ...cdevents.ConverterOption) ForwarderOption {
+	return func(f *Forwarder) {
+		f.converter = cdevents.NewConverter(append([]cdevents.ConverterOption{cdevents.WithSource(f.dest.Source)}, opts...)...)
+	}
+}
+
+// NewForwarder initializes a handler that forwards to the given destination,
+// which must have been compiled. The handler is named after the destination
+func NewForwarder(dest *Destination, opts ...ForwarderOption) *Forwarder {
+	f := &Forwarder{
+		dest:      dest,
+		client:    http.DefaultClient,
+		converter: cdevents.NewConverter(cdevents.WithSource(dest.Source)),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
+}
+
+// Name implements spinnaker.Handler
+func (f *Forwarder) Name() string {
+	return "Forwarder:" + f.dest.Name
+}
+
+// AttachToDispatcher registers the forwarder for the hook types of the filter
+// of its destination, or for every hook type
+func (f *Forwarder) AttachToDispatcher(d *spinnaker.Dispatcher) {
+	if len(f.dest.Filter.HookTypes) == 0 {
+		d.AddHandler(spinnaker.AnyHookType, f)
+		return
+	}
+
+	for _, hookType := range f.dest.Filter.HookTypes {
+		d.AddHandler(hookType, f)
+	}
+}
+
+// Handle implements spinnaker.Handler
+func (f *Forwarder) Handle(incoming *types.IncomingWebhook) error {
+	return f.HandleContext(context.Background(), incoming)
+}
+
+// HandleContext implements spinnaker.ContextHandler. It forwards the webhook
+// when the destination accepts it, retrying until the retries of the
+// destination are exhausted or ctx is done.
+//
+// Webhooks converted to several CDEvents are sent one event at a time and stop
+// at the first event that can't be sent. The events sent before it are sent
+// again when the webhook is delivered again, with the same IDs, so receivers
+// can drop them as duplicates.
+func (f *Forwarder) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	if !f.dest.Accepts(incoming) {
+		return nil
+	}
+
+	payloads, err := f.payloads(incoming)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payloads {
+		if err := f.sendWithRetries(ctx, p); err != nil {
+			return errors.Wrapf(err, "could not forward webhook to %s", f.dest.Name)
+		}
+	}
+
+	return nil
+}
+
+// payload is the headers and body of a request to the destination
+type payload struct {
+	header http.Header
+	body   []byte
+}
+
+// payloads returns the requests the webhook is forwarded with. Webhooks are
+// forwarded with one request, except when they are converted to several
+// CDEvents
+func (f *Forwarder) payloads(incoming *types.IncomingWebhook) ([]payload, error) {
+	if f.dest.Format == FormatCDEvents {
+		events, err := f.converter.Convert(incoming)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not convert webhook to cdevents")
+		}
+
+		payloads := make([]payload, 0, len(events))
+		for _, event := range events {
+			header, body, err := event.Encode(f.dest.Mode)
+			if err != nil {
+				return nil, err
+			}
+			payloads = append(payloads, payload{header: header, body: body})
+		}
+		return payloads, nil
+	}
+
+	body, err := f.body(incoming)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	return []payload{{header: header, body: body}}, nil
+}
+
+// body returns the JSON body forwarded for the webhook
+func (f *Forwarder) body(incoming *types.IncomingWebhook) ([]byte, error) {
+	if f.dest.body == nil {
+		if len(incoming.Raw) > 0 {
+			return incoming.Raw, nil
+		}
+
+		b, err := json.Marshal(incoming)
+		return b, errors.Wrap(err, "could not encode webhook")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := f.dest.body.Execute(buf, incoming); err != nil {
+		return nil, errors.Wrap(err, "could not render body from webhook")
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.Errorf("body of %s did not render to JSON", f.dest.Name)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// sendWithRetries sends the payload until it is accepted, the retries of the
+// destination are exhausted or ctx is done
+func (f *Forwarder) sendWithRetries(ctx context.Context, p payload) error {
+	retries := DefaultRetries
+	if f.dest.Retries != nil {
+		retries = *f.dest.Retries
+	}
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := f.send(ctx, p)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= retries {
+			return err
+		}
+
+		logrus.WithError(err).WithField("destination", f.dest.Name).Warn("could not forward webhook, retrying")
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// send makes one attempt at sending the body and returns whether a failure
+// is worth retrying
+func (f *Forwarder) send(ctx context.Context, p payload) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.dest.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, f.dest.URL, bytes.NewReader(p.body))
+	if err != nil {
+		return false, errors.Wrap(err, "could not create request")
+	}
+	req = req.WithContext(ctx)
+	for name, values := range p.header {
+		req.Header[name] = values
+	}
+	for name, value := range f.dest.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, errors.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return false, nil
+}
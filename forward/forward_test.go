@@ -0,0 +1,247 @@
+package forward_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/cdevents"
+	"github.com/DataDog/spinnaker-datadog-bridge/forward"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+type forwarded struct {
+	header http.Header
+	body   string
+}
+
+// newDestination starts a destination that answers with the given status
+// codes in turn (200 once they run out) and sends every request it receives
+// on the returned channel
+func newDestination(t *testing.T, codes ...int) (*httptest.Server, <-chan forwarded) {
+	requests := make(chan forwarded, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		requests <- forwarded{header: req.Header, body: string(b)}
+
+		code := http.StatusOK
+		if len(codes) > 0 {
+			code, codes = codes[0], codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+
+	return ts, requests
+}
+
+func pipelineComplete(app string) *types.IncomingWebhook {
+	return &types.IncomingWebhook{
+		Details: types.Details{Application: app, Type: "orca:pipeline:complete"},
+		Content: types.Content{
+			ExecutionID: "01C5ZJ",
+			Execution:   types.Execution{Name: "Deploy to prod"},
+		},
+		Raw: []byte(`{"details":{"application":"` + app + `","type":"orca:pipeline:complete"},"content":{"extra":true}}`),
+	}
+}
+
+func compile(t *testing.T, dest *forward.Destination) *forward.Destination {
+	require.NoError(t, dest.Compile())
+	return dest
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := forward.LoadConfig("testdata/forward.yml")
+	require.NoError(t, err)
+	require.Len(t, config.Destinations, 2)
+
+	tracker := config.Destinations[0]
+	assert.Equal(t, "release-tracker", tracker.Name)
+	assert.Equal(t, 3, *tracker.Retries)
+	assert.True(t, tracker.Accepts(pipelineComplete("payments")))
+	assert.False(t, tracker.Accepts(pipelineComplete("hcm")))
+
+	_, err = forward.LoadConfig("testdata/missing.yml")
+	assert.Error(t, err)
+}
+
+func TestForwarderForwardsOriginalWebhook(t *testing.T) {
+	ts, requests := newDestination(t)
+	defer ts.Close()
+
+	os.Setenv("TRACKER_TOKEN", "secret")
+	defer os.Unsetenv("TRACKER_TOKEN")
+
+	f := forward.NewForwarder(compile(t, &forward.Destination{
+		Name:    "release-tracker",
+		URL:     ts.URL,
+		Headers: map[string]string{"Authorization": "Bearer ${TRACKER_TOKEN}"},
+	}))
+	assert.Equal(t, "Forwarder:release-tracker", f.Name())
+	require.NoError(t, f.HandleContext(context.Background(), pipelineComplete("payments")))
+
+	r := <-requests
+	assert.Equal(t, "Bearer secret", r.header.Get("Authorization"))
+	assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+	assert.JSONEq(t, string(pipelineComplete("payments").Raw), r.body)
+}
+
+func TestForwarderForwardsTemplatedBody(t *testing.T) {
+	ts, requests := newDestination(t)
+	defer ts.Close()
+
+	f := forward.NewForwarder(compile(t, &forward.Destination{
+		Name: "chat-bot",
+		URL:  ts.URL,
+		Body: `{"text": {{ json .Details.Application }}, "pipeline": {{ json .Content.Execution.Name }}}`,
+	}))
+	require.NoError(t, f.HandleContext(context.Background(), pipelineComplete(`pay"ments`)))
+
+	r := <-requests
+	assert.JSONEq(t, `{"text": "pay\"ments", "pipeline": "Deploy to prod"}`, r.body)
+}
+
+func TestForwarderRejectsBodiesThatAreNotJSON(t *testing.T) {
+	f := forward.NewForwarder(compile(t, &forward.Destination{
+		Name: "chat-bot",
+		URL:  "http://localhost",
+		Body: `{"text": {{ .Details.Application }}}`,
+	}))
+	assert.Error(t, f.HandleContext(context.Background(), pipelineComplete("payments")))
+}
+
+func TestForwarderFiltersWebhooks(t *testing.T) {
+	ts, requests := newDestination(t)
+	defer ts.Close()
+
+	f := forward.NewForwarder(compile(t, &forward.Destination{
+		Name:   "release-tracker",
+		URL:    ts.URL,
+		Filter: forward.Filter{HookTypes: []string{"orca:pipeline:failed"}},
+	}))
+	require.NoError(t, f.HandleContext(context.Background(), pipelineComplete("payments")))
+
+	select {
+	case <-requests:
+		t.Error("webhook should have been filtered out")
+	default:
+	}
+}
+
+func TestForwarderAttachesToDispatcher(t *testing.T) {
+	ts, requests := newDestination(t)
+	defer ts.Close()
+
+	d := spinnaker.NewDispatcher()
+	forward.NewForwarder(compile(t, &forward.Destination{Name: "everything", URL: ts.URL})).AttachToDispatcher(d)
+	forward.NewForwarder(compile(t, &forward.Destination{
+		Name:   "failures",
+		URL:    ts.URL,
+		Filter: forward.Filter{HookTypes: []string{"orca:pipeline:failed"}},
+	})).AttachToDispatcher(d)
+
+	assert.Len(t, d.Handlers()[spinnaker.AnyHookType], 1)
+	assert.Len(t, d.Handlers()["orca:pipeline:failed"], 1)
+
+	for result := range d.Dispatch(context.Background(), pipelineComplete("payments")) {
+		assert.NoError(t, result.Err)
+		assert.Equal(t, "Forwarder:everything", result.HandlerName)
+	}
+	assert.Len(t, requests, 1)
+}
+
+func TestForwarderRetries(t *testing.T) {
+	t.Run("Given a destination that is unavailable once", func(t *testing.T) {
+		ts, requests := newDestination(t, http.StatusServiceUnavailable)
+		defer ts.Close()
+
+		f := forward.NewForwarder(compile(t, &forward.Destination{Name: "tracker", URL: ts.URL}))
+		require.NoError(t, f.HandleContext(context.Background(), pipelineComplete("payments")))
+		assert.Len(t, requests, 2)
+	})
+
+	t.Run("Given a destination that rejects the webhook", func(t *testing.T) {
+		ts, requests := newDestination(t, http.StatusBadRequest)
+		defer ts.Close()
+
+		f := forward.NewForwarder(compile(t, &forward.Destination{Name: "tracker", URL: ts.URL}))
+		assert.Error(t, f.HandleContext(context.Background(), pipelineComplete("payments")))
+		assert.Len(t, requests, 1)
+	})
+
+	t.Run("Given a destination that is always unavailable", func(t *testing.T) {
+		ts, requests := newDestination(t, http.StatusBadGateway, http.StatusBadGateway)
+		defer ts.Close()
+
+		noRetries := 0
+		f := forward.NewForwarder(compile(t, &forward.Destination{Name: "tracker", URL: ts.URL, Retries: &noRetries}))
+		assert.Error(t, f.HandleContext(context.Background(), pipelineComplete("payments")))
+		assert.Len(t, requests, 1)
+	})
+
+	t.Run("Given a cancelled context", func(t *testing.T) {
+		ts, _ := newDestination(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		defer ts.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		f := forward.NewForwarder(compile(t, &forward.Destination{Name: "tracker", URL: ts.URL}))
+		start := time.Now()
+		assert.Error(t, f.HandleContext(ctx, pipelineComplete("payments")))
+		assert.True(t, time.Since(start) < 400*time.Millisecond, "retries should stop once the context is done")
+	})
+}
+
+func TestForwarderForwardsCDEvents(t *testing.T) {
+	ts, requests := newDestination(t)
+	defer ts.Close()
+
+	f := forward.NewForwarder(compile(t, &forward.Destination{
+		Name:   "event-bus",
+		URL:    ts.URL,
+		Format: forward.FormatCDEvents,
+		Mode:   cdevents.Binary,
+		Source: "/spinnaker/prod",
+	}))
+	require.NoError(t, f.HandleContext(context.Background(), pipelineComplete("payments")))
+
+	r := <-requests
+	assert.Equal(t, cdevents.PipelineRunFinished, r.header.Get("ce-type"))
+	assert.Equal(t, "/spinnaker/prod", r.header.Get("ce-source"))
+	assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+	assert.Contains(t, r.body, `"pipelineName":"Deploy to prod"`)
+}
+
+func TestDestinationRejectsInvalidFormats(t *testing.T) {
+	negativeRetries := -1
+	for name, dest := range map[string]*forward.Destination{
+		"unknown format":      {Name: "a", URL: "http://localhost", Format: "xml"},
+		"unknown mode":        {Name: "a", URL: "http://localhost", Format: forward.FormatCDEvents, Mode: "batched"},
+		"body with cdevents":  {Name: "a", URL: "http://localhost", Format: forward.FormatCDEvents, Body: "{}"},
+		"invalid timeout":     {Name: "a", URL: "http://localhost", Timeout: "soon"},
+		"invalid app pattern": {Name: "a", URL: "http://localhost", Filter: forward.Filter{Application: "["}},
+		"negative retries":    {Name: "a", URL: "http://localhost", Retries: &negativeRetries},
+	} {
+		assert.Error(t, dest.Compile(), name)
+	}
+}
+
+func TestDestinationMaxDuration(t *testing.T) {
+	dest := compile(t, &forward.Destination{Name: "tracker", URL: "http://localhost"})
+	assert.Equal(t, 7500*time.Millisecond, dest.MaxDuration())
+	assert.True(t, dest.MaxDuration() < spinnaker.DefaultHandlerTimeout, "the defaults should fit in the default handler timeout")
+
+	noRetries := 0
+	dest = compile(t, &forward.Destination{Name: "tracker", URL: "http://localhost", Timeout: "10s", Retries: &noRetries})
+	assert.Equal(t, 10*time.Second, dest.MaxDuration())
+}
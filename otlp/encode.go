@@ -0,0 +1,142 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The types below are the subset of the OTLP/JSON encoding of
+// ExportTraceServiceRequest the exporter sends. IDs are hex encoded and
+// timestamps are nanoseconds since the epoch encoded as strings.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type status struct {
+	Code int `json:"code"`
+}
+
+// The span kind and status codes of OTLP
+const (
+	spanKindInternal = 1
+	statusCodeOK     = 1
+	statusCodeError  = 2
+)
+
+// scopeName is the instrumentation scope of every span
+const scopeName = "github.com/DataDog/spinnaker-datadog-bridge/otlp"
+
+// request encodes the spans of the trace. Spans that never received a start
+// or an end are given the bounds of the pipeline
+func (t *trace) request(serviceName string) exportRequest {
+	root := t.spans[""]
+	if root.start.IsZero() {
+		for _, s := range t.spans {
+			if !s.start.IsZero() && (root.start.IsZero() || s.start.Before(root.start)) {
+				root.start = s.start
+			}
+		}
+	}
+
+	traceID := hex.EncodeToString(t.id[:])
+	spans := make([]jsonSpan, 0, len(t.order))
+	for _, key := range t.order {
+		s := t.spans[key]
+		start, end := s.start, s.end
+		if start.IsZero() {
+			start = root.start
+		}
+		if end.IsZero() {
+			end = root.end
+		}
+
+		encoded := jsonSpan{
+			TraceID:           traceID,
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: unixNano(start),
+			EndTimeUnixNano:   unixNano(end),
+			Attributes:        attributes(s.attributes),
+			Status:            status{Code: statusCodeOK},
+		}
+		if s.parent != [8]byte{} {
+			encoded.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.failed {
+			encoded.Status.Code = statusCodeError
+		}
+		spans = append(spans, encoded)
+	}
+
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: attributes(map[string]string{"service.name": serviceName})},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: scopeName}, Spans: spans}},
+	}}}
+}
+
+// attributes returns the given attributes sorted by key
+func attributes(m map[string]string) []keyValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]keyValue, len(keys))
+	for i, k := range keys {
+		kvs[i] = keyValue{Key: k, Value: anyValue{StringValue: m[k]}}
+	}
+
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
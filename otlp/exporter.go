@@ -0,0 +1,378 @@
+// Package otlp exports Spinnaker executions as traces over OTLP/HTTP. Every
+// pipeline execution becomes a trace with a root span for the pipeline and
+// child spans for its stages and tasks.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// DefaultServiceName is the service.name of the traces when none is given
+const DefaultServiceName = "spinnaker"
+
+// DefaultMaxAge is how long the spans of an execution are kept while waiting
+// for the pipeline to complete when no age is given to the exporter
+const DefaultMaxAge = 24 * time.Hour
+
+// HookTypes are the webhooks the exporter builds traces from
+var HookTypes = []string{
+	"orca:pipeline:starting", "orca:pipeline:complete", "orca:pipeline:failed",
+	"orca:stage:starting", "orca:stage:complete", "orca:stage:failed",
+	"orca:task:starting", "orca:task:complete", "orca:task:failed",
+}
+
+// Exporter assembles the spans of executions from their webhooks using the
+// execution ID and sends them to an OTLP/HTTP endpoint once the pipeline
+// completes. Spans of executions that never complete, or whose trace could not
+// be exported, are dropped after MaxAge. Webhooks that arrive after the trace of
+// their execution was exported are ignored.
+type Exporter struct {
+	endpoint    string
+	client      *http.Client
+	headers     map[string]string
+	serviceName string
+	maxAge      time.Duration
+
+	mu     sync.Mutex
+	traces map[string]*trace
+	// exported holds when the trace of recently exported executions was sent,
+	// so late webhooks don't start a new trace that never completes
+	exported map[string]time.Time
+	now      func() time.Time
+}
+
+// ExporterOption configures optional behavior of an exporter
+type ExporterOption func(*Exporter)
+
+// WithHeaders adds the given headers to every export request, for example to
+// authenticate with the collector
+func WithHeaders(headers map[string]string) ExporterOption {
+	return func(e *Exporter) {
+		for k, v := range headers {
+			e.headers[k] = v
+		}
+	}
+}
+
+// WithServiceName sets the service.name resource attribute of the traces
+func WithServiceName(name string) ExporterOption {
+	return func(e *Exporter) {
+		e.serviceName = name
+	}
+}
+
+// WithMaxAge sets how long the spans of an execution are kept while waiting
+// for the pipeline to complete
+func WithMaxAge(d time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.maxAge = d
+	}
+}
+
+// WithHTTPClient sets the client export requests are sent with
+func WithHTTPClient(c *http.Client) ExporterOption {
+	return func(e *Exporter) {
+		e.client = c
+	}
+}
+
+// NewExporter initializes an exporter that sends traces to the OTLP/HTTP
+// endpoint located at endpoint (http://localhost:4318 for example)
+func NewExporter(endpoint string, opts ...ExporterOption) *Exporter {
+	e := &Exporter{
+		endpoint:    strings.TrimRight(endpoint, "/"),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		headers:     make(map[string]string),
+		serviceName: DefaultServiceName,
+		maxAge:      DefaultMaxAge,
+		traces:      make(map[string]*trace),
+		exported:    make(map[string]time.Time),
+		now:         time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
+
+var (
+	_ spinnaker.Handler        = (*Exporter)(nil)
+	_ spinnaker.ContextHandler = (*Exporter)(nil)
+)
+
+// Name implements spinnaker.Handler
+func (e *Exporter) Name() string {
+	return "OTLPTraceExporter"
+}
+
+// AttachToDispatcher registers the exporter for every hook type in HookTypes
+func (e *Exporter) AttachToDispatcher(d *spinnaker.Dispatcher) {
+	for _, hookType := range HookTypes {
+		d.AddHandler(hookType, e)
+	}
+}
+
+// Handle implements spinnaker.Handler
+func (e *Exporter) Handle(incoming *types.IncomingWebhook) error {
+	return e.HandleContext(context.Background(), incoming)
+}
+
+// HandleContext implements spinnaker.ContextHandler. It records the span of the
+// webhook, and exports the trace of the execution when the pipeline completes.
+// The trace is kept when the export fails, so a redelivered pipeline webhook
+// exports it again
+func (e *Exporter) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	executionID := incoming.Content.ExecutionID
+	if executionID == "" {
+		executionID = incoming.Content.Execution.ID
+	}
+	if executionID == "" {
+		return nil
+	}
+
+	parts := strings.Split(incoming.Details.Type, ":")
+	if len(parts) < 3 {
+		return errors.New("could not extract event type details from webhook")
+	}
+	kind, status := parts[1], parts[2]
+
+	e.mu.Lock()
+	e.evict()
+	if _, ok := e.exported[executionID]; ok {
+		e.mu.Unlock()
+		logrus.WithField("execution_id", executionID).Debug("ignoring webhook of an exported trace")
+		return nil
+	}
+	t, ok := e.traces[executionID]
+	if !ok {
+		t = newTrace(executionID)
+		e.traces[executionID] = t
+	}
+	t.updated = e.now()
+	t.record(kind, status, incoming)
+
+	if kind != "pipeline" || status == "starting" {
+		e.mu.Unlock()
+		return nil
+	}
+
+	// The request is built while holding the lock since other webhooks of the
+	// execution can still update the trace while it is exported
+	body, err := json.Marshal(t.request(e.serviceName))
+	spans := len(t.spans)
+	e.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "could not encode trace")
+	}
+
+	if err := e.export(ctx, body); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	if e.traces[executionID] == t {
+		delete(e.traces, executionID)
+	}
+	e.exported[executionID] = e.now()
+	e.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"execution_id": executionID,
+		"spans":        spans,
+	}).Info("exported trace")
+
+	return nil
+}
+
+// evict drops the traces that haven't been updated within maxAge, and forgets
+// the executions exported more than maxAge ago. The caller must hold e.mu
+func (e *Exporter) evict() {
+	now := e.now()
+	for id, t := range e.traces {
+		if now.Sub(t.updated) > e.maxAge {
+			logrus.WithField("execution_id", id).Debug("dropping incomplete trace")
+			delete(e.traces, id)
+		}
+	}
+	for id, at := range e.exported {
+		if now.Sub(at) > e.maxAge {
+			delete(e.exported, id)
+		}
+	}
+}
+
+// export sends the encoded spans of a trace to the collector
+func (e *Exporter) export(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "could not create request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not reach otlp endpoint")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected status code from otlp endpoint: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// trace holds the spans of an execution until its pipeline completes. Spans
+// are keyed by "" for the pipeline, the stage ID for stages and the stage ID
+// and task name for tasks
+type trace struct {
+	executionID string
+	id          [16]byte
+	spans       map[string]*span
+	order       []string
+	updated     time.Time
+}
+
+type span struct {
+	name       string
+	id         [8]byte
+	parent     [8]byte
+	start, end time.Time
+	failed     bool
+	attributes map[string]string
+}
+
+func newTrace(executionID string) *trace {
+	t := &trace{executionID: executionID, spans: make(map[string]*span)}
+	sum := sha256.Sum256([]byte(executionID))
+	copy(t.id[:], sum[:])
+
+	return t
+}
+
+// span returns the span with the given key, creating it if needed. IDs are
+// derived from the execution ID and the key so webhooks arriving out of order
+// still agree on them
+func (t *trace) span(key, name string, parent *span) *span {
+	s, ok := t.spans[key]
+	if !ok {
+		s = &span{name: name, attributes: make(map[string]string)}
+		sum := sha256.Sum256([]byte(t.executionID + "\xff" + key))
+		copy(s.id[:], sum[:])
+		t.spans[key] = s
+		t.order = append(t.order, key)
+	}
+	if parent != nil {
+		s.parent = parent.id
+	}
+
+	return s
+}
+
+// record updates the spans of the trace from the given webhook
+func (t *trace) record(kind, status string, incoming *types.IncomingWebhook) {
+	execution := incoming.Content.Execution
+	at := webhookTime(incoming)
+
+	root := t.span("", execution.Name, nil)
+	if root.name == "" {
+		root.name = execution.Name
+	}
+	setAttribute(root.attributes, "spinnaker.application", incoming.Details.Application)
+	setAttribute(root.attributes, "spinnaker.execution.id", t.executionID)
+	setAttribute(root.attributes, "spinnaker.pipeline.name", execution.Name)
+	setAttribute(root.attributes, "spinnaker.pipeline.id", execution.PipelineConfigID)
+	setAttribute(root.attributes, "spinnaker.trigger.type", execution.Trigger.Type)
+	setAttribute(root.attributes, "spinnaker.trigger.user", execution.Trigger.User)
+
+	var s *span
+	switch kind {
+	case "pipeline":
+		s = root
+		at = firstTime(execution.StartTime, at)
+		if status != "starting" {
+			at = firstTime(execution.EndTime, at)
+			setAttribute(root.attributes, "spinnaker.execution.status", execution.Status)
+		}
+	case "stage", "task":
+		stage := incoming.Content.StageDetails()
+		s = t.span("stage/"+stage.Key(), stage.Name, root)
+		setAttribute(s.attributes, "spinnaker.stage.name", stage.Name)
+		setAttribute(s.attributes, "spinnaker.stage.type", stage.Type)
+
+		if kind == "stage" {
+			if status == "starting" {
+				at = firstTime(stage.StartTime, at)
+			} else {
+				at = firstTime(stage.EndTime, at)
+			}
+			break
+		}
+
+		if s.start.IsZero() {
+			s.start = firstTime(stage.StartTime, at)
+		}
+		taskName := incoming.Content.TaskName
+		s = t.span("task/"+stage.Key()+"/"+taskName, taskName, s)
+		setAttribute(s.attributes, "spinnaker.task.name", taskName)
+	default:
+		return
+	}
+
+	switch status {
+	case "starting":
+		s.start = at
+	case "failed":
+		s.failed = true
+		fallthrough
+	default:
+		s.end = at
+		if s.start.IsZero() {
+			s.start = at
+		}
+	}
+}
+
+func setAttribute(attributes map[string]string, key, value string) {
+	if value != "" {
+		attributes[key] = value
+	}
+}
+
+// webhookTime returns when the webhook was created by Echo
+func webhookTime(incoming *types.IncomingWebhook) time.Time {
+	ms, err := strconv.ParseInt(incoming.Details.Created, 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func firstTime(ts types.Timestamp, fallback time.Time) time.Time {
+	if ts.IsZero() {
+		return fallback
+	}
+
+	return ts.Time
+}
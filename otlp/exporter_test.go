@@ -0,0 +1,248 @@
+package otlp_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/otlp"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+)
+
+type exportedSpan struct {
+	TraceID           string `json:"traceId"`
+	SpanID            string `json:"spanId"`
+	ParentSpanID      string `json:"parentSpanId"`
+	Name              string `json:"name"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string `json:"endTimeUnixNano"`
+	Attributes        []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s exportedSpan) attribute(key string) string {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value.StringValue
+		}
+	}
+
+	return ""
+}
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string `json:"key"`
+				Value struct {
+					StringValue string `json:"stringValue"`
+				} `json:"value"`
+			} `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []exportedSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// newCollector starts a stand-in for an OTLP/HTTP collector that sends every
+// export request it receives on the returned channel
+func newCollector(t *testing.T) (*httptest.Server, <-chan exportRequest) {
+	requests := make(chan exportRequest, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", req.Header.Get("X-Api-Key"))
+
+		var r exportRequest
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&r))
+		requests <- r
+	}))
+
+	return ts, requests
+}
+
+func webhook(hookType, context string) []byte {
+	return []byte(`{
+		"details": {"type": "` + hookType + `", "application": "hcm", "created": "1518214003433"},
+		"content": {
+			"executionId": "01C5ZJ",
+			"taskName": "deploy.createServerGroup",
+			"context": {"stageDetails": {"name": "Deploy", "type": "deploy"` + context + `}},
+			"execution": {
+				"id": "01C5ZJ",
+				"name": "Deploy to prod",
+				"status": "TERMINAL",
+				"pipelineConfigId": "abc",
+				"startTime": 1518214000000,
+				"endTime": 1518214010000,
+				"trigger": {"type": "manual", "user": "someone"}
+			}
+		}
+	}`)
+}
+
+func TestExporterExportsExecutionsAsTraces(t *testing.T) {
+	ts, requests := newCollector(t)
+	defer ts.Close()
+
+	d := spinnaker.NewDispatcher()
+	otlp.NewExporter(ts.URL, otlp.WithHeaders(map[string]string{"X-Api-Key": "secret"})).AttachToDispatcher(d)
+
+	for _, body := range [][]byte{
+		webhook("orca:pipeline:starting", ""),
+		webhook("orca:stage:starting", `, "startTime": 1518214001000`),
+		webhook("orca:task:complete", ""),
+		webhook("orca:stage:failed", `, "startTime": 1518214001000, "endTime": 1518214009000`),
+	} {
+		results, err := d.DispatchJSON(context.Background(), body)
+		require.NoError(t, err)
+		for result := range results {
+			require.NoError(t, result.Err)
+		}
+	}
+	assert.Empty(t, requests, "nothing should be exported before the pipeline completes")
+
+	results, err := d.DispatchJSON(context.Background(), webhook("orca:pipeline:failed", ""))
+	require.NoError(t, err)
+	for result := range results {
+		require.NoError(t, result.Err)
+	}
+
+	r := <-requests
+	require.Len(t, r.ResourceSpans, 1)
+	assert.Equal(t, "service.name", r.ResourceSpans[0].Resource.Attributes[0].Key)
+	assert.Equal(t, "spinnaker", r.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	spans := r.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 3)
+	pipeline, stage, task := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "Deploy to prod", pipeline.Name)
+	assert.Empty(t, pipeline.ParentSpanID)
+	assert.Equal(t, "1518214000000000000", pipeline.StartTimeUnixNano)
+	assert.Equal(t, "1518214010000000000", pipeline.EndTimeUnixNano)
+	assert.Equal(t, 2, pipeline.Status.Code)
+	assert.Equal(t, "hcm", pipeline.attribute("spinnaker.application"))
+	assert.Equal(t, "TERMINAL", pipeline.attribute("spinnaker.execution.status"))
+	assert.Equal(t, "someone", pipeline.attribute("spinnaker.trigger.user"))
+	assert.Len(t, pipeline.TraceID, 32)
+	assert.Len(t, pipeline.SpanID, 16)
+
+	assert.Equal(t, "Deploy", stage.Name)
+	assert.Equal(t, pipeline.SpanID, stage.ParentSpanID)
+	assert.Equal(t, pipeline.TraceID, stage.TraceID)
+	assert.Equal(t, "1518214001000000000", stage.StartTimeUnixNano)
+	assert.Equal(t, "1518214009000000000", stage.EndTimeUnixNano)
+	assert.Equal(t, 2, stage.Status.Code)
+
+	assert.Equal(t, "deploy.createServerGroup", task.Name)
+	assert.Equal(t, stage.SpanID, task.ParentSpanID)
+	assert.Equal(t, "1518214003433000000", task.EndTimeUnixNano)
+	assert.Equal(t, 1, task.Status.Code)
+}
+
+func TestExporterReportsCollectorErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	d := spinnaker.NewDispatcher()
+	otlp.NewExporter(ts.URL).AttachToDispatcher(d)
+
+	results, err := d.DispatchJSON(context.Background(), webhook("orca:pipeline:complete", ""))
+	require.NoError(t, err)
+
+	result := <-results
+	assert.Error(t, result.Err)
+}
+
+// dispatch sends the given webhook to the dispatcher and fails the test if one
+// of its handlers fails
+func dispatch(t *testing.T, d *spinnaker.Dispatcher, body []byte) {
+	results, err := d.DispatchJSON(context.Background(), body)
+	require.NoError(t, err)
+	for result := range results {
+		require.NoError(t, result.Err)
+	}
+}
+
+func TestExporterKeepsStagesWithTheSameName(t *testing.T) {
+	ts, requests := newCollector(t)
+	defer ts.Close()
+
+	d := spinnaker.NewDispatcher()
+	otlp.NewExporter(ts.URL, otlp.WithHeaders(map[string]string{"X-Api-Key": "secret"})).AttachToDispatcher(d)
+
+	stageWebhook := func(start string) []byte {
+		return []byte(`{
+			"details": {"type": "orca:stage:complete", "application": "hcm"},
+			"content": {
+				"executionId": "01C5ZJ",
+				"context": {"stageDetails": {"name": "Wait", "type": "wait", "startTime": ` + start + `}},
+				"execution": {
+					"id": "01C5ZJ",
+					"stages": [
+						{"id": "01STAGE1", "name": "Wait", "startTime": 1518214001000},
+						{"id": "01STAGE2", "name": "Wait", "startTime": 1518214005000}
+					]
+				}
+			}
+		}`)
+	}
+	dispatch(t, d, stageWebhook("1518214001000"))
+	dispatch(t, d, stageWebhook("1518214005000"))
+	dispatch(t, d, webhook("orca:pipeline:complete", ""))
+
+	r := <-requests
+	spans := r.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 3)
+	assert.Equal(t, "Wait", spans[1].Name)
+	assert.Equal(t, "Wait", spans[2].Name)
+	assert.NotEqual(t, spans[1].SpanID, spans[2].SpanID)
+}
+
+func TestExporterKeepsTracesUntilExported(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	d := spinnaker.NewDispatcher()
+	otlp.NewExporter(ts.URL).AttachToDispatcher(d)
+
+	dispatch(t, d, webhook("orca:stage:complete", ""))
+
+	results, err := d.DispatchJSON(context.Background(), webhook("orca:pipeline:complete", ""))
+	require.NoError(t, err)
+	assert.Error(t, (<-results).Err)
+
+	t.Run("Given a redelivered pipeline webhook", func(t *testing.T) {
+		dispatch(t, d, webhook("orca:pipeline:complete", ""))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("Given webhooks after the trace was exported", func(t *testing.T) {
+		dispatch(t, d, webhook("orca:task:complete", ""))
+		dispatch(t, d, webhook("orca:pipeline:complete", ""))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "late webhooks should not start a new trace")
+	})
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Check reports whether something the server depends on is ready. A nil error
+// means it is
+type Check func() error
+
+type readinessCheck struct {
+	name  string
+	check Check
+}
+
+// BuildInfo describes the build of the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// CheckResult is the result of a single readiness check
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessResponse is returned by /readyz with the result of every check
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// WithReadinessCheck adds a check that must pass for /readyz to report the
+// server as ready
+func WithReadinessCheck(name string, check Check) Option {
+	return func(s *Server) {
+		s.readinessChecks = append(s.readinessChecks, readinessCheck{name: name, check: check})
+	}
+}
+
+// WithBuildInfo sets the build information returned by /version
+func WithBuildInfo(info BuildInfo) Option {
+	return func(s *Server) {
+		s.buildInfo = info
+	}
+}
+
+// handleHealthz reports that the process is alive. It doesn't depend on
+// anything so a failing dependency never gets the bridge restarted
+func (s *Server) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz runs every readiness check and reports each of their results
+func (s *Server) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	resp := ReadinessResponse{
+		Status: "ok",
+		Checks: make(map[string]CheckResult, len(s.readinessChecks)),
+	}
+
+	for _, rc := range s.readinessChecks {
+		if err := rc.check(); err != nil {
+			logrus.WithError(err).WithField("check", rc.name).Warn("readiness check failed")
+			resp.Status = "unavailable"
+			resp.Checks[rc.name] = CheckResult{Status: "error", Error: err.Error()}
+			continue
+		}
+
+		resp.Checks[rc.name] = CheckResult{Status: "ok"}
+	}
+
+	code := http.StatusOK
+	if resp.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, resp)
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, req *http.Request) {
+	info := s.buildInfo
+	if info.GoVersion == "" {
+		info.GoVersion = runtime.Version()
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Error("could not encode response")
+	}
+}
+
+// CachedCheck wraps a check so it runs at most once per ttl. This is useful for
+// checks that call external APIs which shouldn't be hit on every probe
+func CachedCheck(check Check, ttl time.Duration) Check {
+	var (
+		mu      sync.Mutex
+		lastErr error
+		expires time.Time
+	)
+
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Now().Before(expires) {
+			return lastErr
+		}
+
+		lastErr = check()
+		expires = time.Now().Add(ttl)
+		return lastErr
+	}
+}
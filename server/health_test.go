@@ -0,0 +1,86 @@
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/server"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+)
+
+func TestHealthz(t *testing.T) {
+	s := server.New(":0", spinnaker.NewDispatcher(), server.WithReadinessCheck("broken", func() error {
+		return errors.New("broken")
+	}))
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReadyz(t *testing.T) {
+	t.Run("Given passing checks", func(t *testing.T) {
+		s := server.New(":0", spinnaker.NewDispatcher(), server.WithReadinessCheck("templates", func() error {
+			return nil
+		}))
+
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp server.ReadinessResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, "ok", resp.Status)
+		assert.Equal(t, "ok", resp.Checks["templates"].Status)
+	})
+
+	t.Run("Given a failing check", func(t *testing.T) {
+		s := server.New(":0", spinnaker.NewDispatcher(),
+			server.WithReadinessCheck("templates", func() error { return nil }),
+			server.WithReadinessCheck("statsd", func() error { return errors.New("connection refused") }),
+		)
+
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+		var resp server.ReadinessResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, "unavailable", resp.Status)
+		assert.Equal(t, "ok", resp.Checks["templates"].Status)
+		assert.Equal(t, server.CheckResult{Status: "error", Error: "connection refused"}, resp.Checks["statsd"])
+	})
+}
+
+func TestVersion(t *testing.T) {
+	s := server.New(":0", spinnaker.NewDispatcher(), server.WithBuildInfo(server.BuildInfo{Version: "1.2.3", Commit: "abc"}))
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var info server.BuildInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+	assert.Equal(t, "1.2.3", info.Version)
+	assert.Equal(t, "abc", info.Commit)
+	assert.NotEmpty(t, info.GoVersion)
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := server.CachedCheck(func() error {
+		calls++
+		return errors.New("invalid key")
+	}, time.Minute)
+
+	require.Error(t, check())
+	require.Error(t, check())
+	assert.Equal(t, 1, calls)
+}
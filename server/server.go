@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
 )
 
 // Server handles incoming webhook requests and pushes them to a dispatcher
@@ -15,23 +17,74 @@ type Server struct {
 	Addr       string
 	mux        *mux.Router
 	dispatcher *spinnaker.Dispatcher
+	httpServer *http.Server
+
+	readinessChecks []readinessCheck
+	buildInfo       BuildInfo
+	recorder        telemetry.Recorder
+	metricsHandler  http.Handler
+}
+
+// Option configures optional behavior of a server
+type Option func(*Server)
+
+// WithRecorder records every request and webhook timeout with the given recorder
+func WithRecorder(r telemetry.Recorder) Option {
+	return func(s *Server) {
+		s.recorder = r
+	}
+}
+
+// WithMetricsHandler serves the self-metrics of the bridge from the given
+// handler at /metrics
+func WithMetricsHandler(h http.Handler) Option {
+	return func(s *Server) {
+		s.metricsHandler = h
+	}
 }
 
 // New initializes and returns a server that will listen on the given address
 // and dispatch events from incoming webhooks
-func New(address string, d *spinnaker.Dispatcher) *Server {
-	return &Server{
+func New(address string, d *spinnaker.Dispatcher, opts ...Option) *Server {
+	s := &Server{
 		Addr:       address,
 		dispatcher: d,
+		recorder:   telemetry.Nop{},
 	}
+	s.httpServer = &http.Server{Addr: address}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
-// Start starts a server to accept Spinnaker webhook events
+// Start starts a server to accept Spinnaker webhook events. It blocks until
+// the server fails or is shut down, in which case it returns nil
 func (s *Server) Start() error {
 	s.prepare()
+	s.httpServer.Handler = s.mux
 	logrus.WithField("addr", s.Addr).Info("starting server")
 
-	return http.ListenAndServe(s.Addr, s.mux)
+	if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Handler returns the HTTP handler of the server with all of its routes
+func (s *Server) Handler() http.Handler {
+	s.prepare()
+	return s.mux
+}
+
+// Shutdown stops accepting new webhooks and waits for the requests that are
+// being handled to finish or the given context to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	logrus.Info("shutting down server")
+	return s.httpServer.Shutdown(ctx)
 }
 
 func (s *Server) prepare() {
@@ -42,20 +95,37 @@ func (s *Server) prepare() {
 	router := mux.NewRouter()
 	router.HandleFunc("/webhook", s.handleWebhook)
 	router.HandleFunc("/webhook/", s.handleWebhook)
+	router.HandleFunc("/healthz", s.handleHealthz).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", s.handleReadyz).Methods(http.MethodGet)
+	router.HandleFunc("/version", s.handleVersion).Methods(http.MethodGet)
+	if s.metricsHandler != nil {
+		router.Handle("/metrics", s.metricsHandler).Methods(http.MethodGet)
+	}
 	router.Use(s.loggingMiddleware)
 
 	s.mux = router
 }
 
+// webhookTimeoutGrace is how much longer than the timeouts of its handlers the
+// server waits for a webhook to be handled
+const webhookTimeoutGrace = time.Second
+
 func (s *Server) handleWebhook(w http.ResponseWriter, req *http.Request) {
 	results, err := s.dispatcher.HandleIncomingRequest(req)
+	if err == spinnaker.ErrWebhookTooLarge {
+		logrus.WithField("content_length", req.ContentLength).Error("rejecting webhook that is too large")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		logrus.WithError(err).Error("could not handle incoming request")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	deadline := time.After(time.Second * 10)
+	// Handlers time out on their own, so the grace only has to cover the time
+	// it takes them to return once they do
+	deadline := time.After(s.dispatcher.WebhookTimeout() + webhookTimeoutGrace)
 	for {
 		select {
 		case res, more := <-results:
@@ -74,6 +144,7 @@ func (s *Server) handleWebhook(w http.ResponseWriter, req *http.Request) {
 			}
 		case <-deadline:
 			logrus.Error("timed out while waiting for dispatcher results")
+			s.recorder.WebhookTimedOut()
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
@@ -83,10 +154,35 @@ func (s *Server) handleWebhook(w http.ResponseWriter, req *http.Request) {
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		took := time.Since(start)
+
+		// The route template keeps the path label bounded regardless of what
+		// clients request
+		path := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				path = tmpl
+			}
+		}
+		s.recorder.RequestHandled(path, sw.code, took)
+
 		logrus.WithFields(logrus.Fields{
 			"uri":      r.RequestURI,
-			"duration": time.Since(start).String(),
+			"status":   sw.code,
+			"duration": took.String(),
 		}).Info("incoming request")
 	})
 }
+
+// statusWriter remembers the status code written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,38 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/server"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+func TestWebhookWaitsForHandlerTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a handler running longer than 10 seconds")
+	}
+
+	d := spinnaker.NewDispatcher(spinnaker.WithHandlerTimeout(12 * time.Second))
+	d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("slow", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		select {
+		case <-time.After(10*time.Second + 500*time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}))
+	s := server.New(":0", d)
+
+	body := []byte(`{"details":{"type":"orca:stage:complete"}}`)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+}
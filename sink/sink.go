@@ -0,0 +1,166 @@
+// Package sink defines the destinations rendered Spinnaker events and metrics
+// are sent to. The Datadog API and DogStatsD are one implementation, see the
+// spinnakerdatadog package.
+package sink
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// Sink receives the events, metrics and service checks rendered from
+// Spinnaker webhooks. Calls should give up once ctx is done.
+type Sink interface {
+	// Name identifies the sink in templates and logs
+	Name() string
+	SendEvent(ctx context.Context, event *Event) error
+	SendMetric(ctx context.Context, metric *Metric) error
+	SendServiceCheck(ctx context.Context, check *ServiceCheck) error
+}
+
+// Event is an event rendered from a webhook template
+type Event struct {
+	Title          string
+	Text           string
+	AggregationKey string
+	// AlertType is one of "error", "warning", "info" or "success", it is
+	// left empty for informational events
+	AlertType string
+	Tags      []string
+	Timestamp time.Time
+
+	// Webhook is the webhook the event was rendered from, for sinks that send
+	// more than the rendered event
+	Webhook *types.IncomingWebhook
+}
+
+// MetricType is the kind of value a metric holds
+type MetricType string
+
+// The metric types a sink may receive
+const (
+	Gauge MetricType = "gauge"
+	Count MetricType = "count"
+	// Timing values are in milliseconds
+	Timing MetricType = "timing"
+)
+
+// Metric is a single measurement derived from a webhook. Names don't include
+// a namespace, sinks add their own
+type Metric struct {
+	Name  string
+	Type  MetricType
+	Value float64
+	Tags  []string
+}
+
+// ServiceCheckStatus is the status of a service check
+type ServiceCheckStatus int
+
+// The statuses of a service check, with the same values as Datadog's
+const (
+	OK ServiceCheckStatus = iota
+	Warning
+	Critical
+	Unknown
+)
+
+// ServiceCheck reports the status of something derived from a webhook, such
+// as a pipeline
+type ServiceCheck struct {
+	Name    string
+	Status  ServiceCheckStatus
+	Message string
+	Tags    []string
+}
+
+// Errors is returned when sending to several sinks fails for some of them
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Fanout is a sink that sends to all of its sinks at once, even when some of
+// them fail. It returns an Errors with the errors of the sinks that failed
+type Fanout []Sink
+
+var _ Sink = Fanout(nil)
+
+// Name implements Sink
+func (f Fanout) Name() string {
+	names := make([]string, len(f))
+	for i, s := range f {
+		names[i] = s.Name()
+	}
+
+	return strings.Join(names, ",")
+}
+
+// SendEvent implements Sink
+func (f Fanout) SendEvent(ctx context.Context, event *Event) error {
+	return f.each(func(s Sink) error { return s.SendEvent(ctx, event) })
+}
+
+// SendMetric implements Sink
+func (f Fanout) SendMetric(ctx context.Context, metric *Metric) error {
+	return f.each(func(s Sink) error { return s.SendMetric(ctx, metric) })
+}
+
+// SendServiceCheck implements Sink
+func (f Fanout) SendServiceCheck(ctx context.Context, check *ServiceCheck) error {
+	return f.each(func(s Sink) error { return s.SendServiceCheck(ctx, check) })
+}
+
+// each sends to every sink in parallel so a slow sink doesn't hold up the others
+func (f Fanout) each(send func(Sink) error) error {
+	results := make([]error, len(f))
+
+	var wg sync.WaitGroup
+	wg.Add(len(f))
+	for i, s := range f {
+		go func(i int, s Sink) {
+			defer wg.Done()
+			if err := send(s); err != nil {
+				results[i] = &sinkError{sink: s.Name(), err: err}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	var errs Errors
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+type sinkError struct {
+	sink string
+	err  error
+}
+
+func (e *sinkError) Error() string {
+	return e.sink + ": " + e.err.Error()
+}
+
+// Cause returns the error of the sink, for errors.Cause
+func (e *sinkError) Cause() error {
+	return e.err
+}
@@ -0,0 +1,69 @@
+package sink_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
+)
+
+type recordingSink struct {
+	name string
+	err  error
+
+	mu     sync.Mutex
+	events []*sink.Event
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) SendEvent(ctx context.Context, event *sink.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return s.err
+}
+
+func (s *recordingSink) SendMetric(ctx context.Context, metric *sink.Metric) error {
+	return s.err
+}
+
+func (s *recordingSink) SendServiceCheck(ctx context.Context, check *sink.ServiceCheck) error {
+	return s.err
+}
+
+func TestFanoutSendsToEverySink(t *testing.T) {
+	first := &recordingSink{name: "first"}
+	second := &recordingSink{name: "second"}
+	fanout := sink.Fanout{first, second}
+
+	event := &sink.Event{Title: "deployed"}
+	require.NoError(t, fanout.SendEvent(context.Background(), event))
+
+	assert.Equal(t, "first,second", fanout.Name())
+	assert.Equal(t, []*sink.Event{event}, first.events)
+	assert.Equal(t, []*sink.Event{event}, second.events)
+}
+
+func TestFanoutKeepsSendingWhenASinkFails(t *testing.T) {
+	failing := &recordingSink{name: "failing", err: errors.New("nope")}
+	working := &recordingSink{name: "working"}
+	fanout := sink.Fanout{failing, working}
+
+	err := fanout.SendEvent(context.Background(), &sink.Event{Title: "deployed"})
+	require.Error(t, err)
+	assert.Equal(t, "failing: nope", err.Error())
+	assert.Len(t, working.events, 1)
+
+	errs, ok := err.(sink.Errors)
+	require.True(t, ok)
+	assert.Len(t, errs, 1)
+
+	assert.NoError(t, sink.Fanout{working}.SendMetric(context.Background(), &sink.Metric{Name: "pipeline.duration"}))
+	assert.Error(t, sink.Fanout{failing}.SendServiceCheck(context.Background(), &sink.ServiceCheck{Name: "pipeline"}))
+}
@@ -0,0 +1,163 @@
+package spinnaker
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// DefaultDedupMaxEntries is how many webhooks are remembered for deduplication
+// when no limit is given to WithDeduplication
+const DefaultDedupMaxEntries = 10000
+
+// WithDeduplication drops webhooks that were already dispatched within the
+// given TTL. Echo retries and multiple Echo replicas can deliver the same
+// webhook more than once. At most maxEntries webhooks are remembered, the
+// oldest are forgotten first.
+//
+// Webhooks are identified by their hook type, execution ID, stage (see
+// types.StageDetails.Key), task and end time. Webhooks without an execution ID
+// are never dropped. A webhook whose handlers fail is dispatched again when it
+// is delivered again, but only to the handlers that didn't succeed the first
+// time.
+func WithDeduplication(ttl time.Duration, maxEntries int) DispatcherOption {
+	return func(d *Dispatcher) {
+		if maxEntries <= 0 {
+			maxEntries = DefaultDedupMaxEntries
+		}
+
+		d.dedup = &deduplicator{
+			ttl:        ttl,
+			maxEntries: maxEntries,
+			entries:    make(map[string]*list.Element),
+			order:      list.New(),
+			now:        time.Now,
+		}
+	}
+}
+
+// dedupKey identifies a webhook across deliveries. It is empty for webhooks
+// that can't be identified
+func dedupKey(incoming *types.IncomingWebhook) string {
+	executionID := incoming.Content.ExecutionID
+	if executionID == "" {
+		executionID = incoming.Content.Execution.ID
+	}
+	if executionID == "" {
+		return ""
+	}
+
+	stage := incoming.Content.StageDetails()
+	endTime := stage.EndTime
+	if endTime.IsZero() {
+		endTime = incoming.Content.EndTime
+	}
+	if endTime.IsZero() {
+		endTime = incoming.Content.Execution.EndTime
+	}
+
+	var end int64
+	if !endTime.IsZero() {
+		end = endTime.UnixNano()
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%s|%d", incoming.Details.Type, executionID, stage.Key(), incoming.Content.TaskName, end)
+}
+
+// deduplicator remembers the webhooks that were dispatched in insertion order
+// so expired and overflowing entries are evicted from the front
+type deduplicator struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+
+	// retry is set when handlers failed, until the webhook is delivered again
+	retry bool
+	// succeeded holds the names of the handlers that already succeeded
+	succeeded map[string]bool
+}
+
+// seen remembers the given key and returns whether it was already remembered.
+// Keys of webhooks whose handlers failed aren't seen the next time, and the
+// handlers that already succeeded for them are returned instead
+func (dd *deduplicator) seen(key string) (succeeded map[string]bool, seen bool) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	now := dd.now()
+	for front := dd.order.Front(); front != nil; front = dd.order.Front() {
+		if entry := front.Value.(*dedupEntry); now.Before(entry.expires) {
+			break
+		}
+		dd.remove(front)
+	}
+
+	if element, ok := dd.entries[key]; ok {
+		entry := element.Value.(*dedupEntry)
+		if !entry.retry {
+			return nil, true
+		}
+
+		entry.retry = false
+		succeeded = make(map[string]bool, len(entry.succeeded))
+		for name := range entry.succeeded {
+			succeeded[name] = true
+		}
+		return succeeded, false
+	}
+
+	dd.add(&dedupEntry{key: key, expires: now.Add(dd.ttl)})
+
+	return nil, false
+}
+
+// failed marks the webhook with the given key to be dispatched again, only to
+// the handlers that aren't among the given handlers that succeeded
+func (dd *deduplicator) failed(key string, succeeded []string) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	element, ok := dd.entries[key]
+	if !ok {
+		element = dd.add(&dedupEntry{key: key, expires: dd.now().Add(dd.ttl)})
+	}
+
+	entry := element.Value.(*dedupEntry)
+	entry.retry = true
+	if entry.succeeded == nil {
+		entry.succeeded = make(map[string]bool, len(succeeded))
+	}
+	for _, name := range succeeded {
+		entry.succeeded[name] = true
+	}
+}
+
+// add remembers the given entry, evicting the oldest entries beyond the limit.
+// The caller must hold dd.mu
+func (dd *deduplicator) add(entry *dedupEntry) *list.Element {
+	element := dd.order.PushBack(entry)
+	dd.entries[entry.key] = element
+	for dd.order.Len() > dd.maxEntries {
+		dd.remove(dd.order.Front())
+	}
+
+	return element
+}
+
+// remove evicts the given entry. The caller must hold dd.mu
+func (dd *deduplicator) remove(element *list.Element) {
+	dd.order.Remove(element)
+	delete(dd.entries, element.Value.(*dedupEntry).key)
+}
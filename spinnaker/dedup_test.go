@@ -0,0 +1,128 @@
+package spinnaker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+func webhookEndingAt(executionID string, endTime int64) []byte {
+	return []byte(fmt.Sprintf(`{
+		"details": {"type": "orca:stage:complete"},
+		"content": {
+			"executionId": %q,
+			"context": {"stageDetails": {"name": "Deploy", "endTime": %d}}
+		}
+	}`, executionID, endTime))
+}
+
+// dispatchCount dispatches the given webhook and returns how many handlers ran
+func dispatchCount(t *testing.T, d *spinnaker.Dispatcher, body []byte) int {
+	results, err := d.DispatchJSON(context.Background(), body)
+	require.NoError(t, err)
+
+	var count int
+	for range results {
+		count++
+	}
+
+	return count
+}
+
+func TestDispatcherDropsDuplicateWebhooks(t *testing.T) {
+	noop := func(ctx context.Context, incoming *types.IncomingWebhook) error { return nil }
+
+	t.Run("Given the same webhook twice", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithDeduplication(time.Minute, 0))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", noop))
+
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		assert.Equal(t, 0, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214063000)))
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("def", 1518214003000)))
+	})
+
+	t.Run("Given stages sharing a name", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithDeduplication(time.Minute, 0))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", noop))
+
+		stage := func(id string) []byte {
+			return []byte(fmt.Sprintf(`{
+				"details": {"type": "orca:stage:complete"},
+				"content": {
+					"executionId": "abc",
+					"context": {"stageDetails": {"id": %q, "name": "Deploy", "endTime": 1518214003000}}
+				}
+			}`, id))
+		}
+		assert.Equal(t, 1, dispatchCount(t, d, stage("01")))
+		assert.Equal(t, 1, dispatchCount(t, d, stage("02")))
+		assert.Equal(t, 0, dispatchCount(t, d, stage("02")))
+	})
+
+	t.Run("Given a webhook without an execution ID", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithDeduplication(time.Minute, 0))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", noop))
+
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("", 1518214003000)))
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("", 1518214003000)))
+	})
+
+	t.Run("Given a webhook older than the TTL", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithDeduplication(time.Millisecond*10, 0))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", noop))
+
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		time.Sleep(time.Millisecond * 20)
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+	})
+
+	t.Run("Given more webhooks than are remembered", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithDeduplication(time.Minute, 1))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", noop))
+
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("def", 1518214003000)))
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+	})
+
+	t.Run("Given a webhook whose handlers failed", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithDeduplication(time.Minute, 0))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+			return errors.New("nope")
+		}))
+
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+	})
+
+	t.Run("Given a webhook whose handlers partly failed", func(t *testing.T) {
+		var sent, attempts int
+		d := spinnaker.NewDispatcher(spinnaker.WithDeduplication(time.Minute, 0))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("sender", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+			sent++
+			return nil
+		}))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("flaky", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+			attempts++
+			if attempts == 1 {
+				return errors.New("nope")
+			}
+			return nil
+		}))
+
+		assert.Equal(t, 2, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		assert.Equal(t, 1, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		assert.Equal(t, 0, dispatchCount(t, d, webhookEndingAt("abc", 1518214003000)))
+		assert.Equal(t, 1, sent)
+		assert.Equal(t, 2, attempts)
+	})
+}
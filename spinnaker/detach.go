@@ -0,0 +1,46 @@
+package spinnaker
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type detachKey struct{}
+
+// detached tracks the work a handler started in the background during one run
+type detached struct {
+	d           *Dispatcher
+	outstanding int64
+}
+
+// Detach marks the start of work a handler runs in the background that can
+// outlive the handler, such as a call that can't be cancelled and is abandoned
+// once the context is done. The work counts as in flight, so Drain waits for
+// it, until the returned function is called when the work returns. Handlers
+// that return while detached work is still running are recorded as abandoned.
+// Outside of a dispatch, Detach does nothing.
+func Detach(ctx context.Context) (done func()) {
+	w, ok := ctx.Value(detachKey{}).(*detached)
+	if !ok {
+		return func() {}
+	}
+
+	atomic.AddInt64(&w.outstanding, 1)
+	w.d.inFlight.Add(1)
+	w.d.recorder.HandlersInFlight(int(atomic.AddInt64(&w.d.inFlightCount, 1)))
+
+	return func() {
+		atomic.AddInt64(&w.outstanding, -1)
+		w.d.recorder.HandlersInFlight(int(atomic.AddInt64(&w.d.inFlightCount, -1)))
+		w.d.inFlight.Done()
+	}
+}
+
+// withDetached returns a context handlers can detach work from, along with a
+// function reporting whether detached work is still running
+func (d *Dispatcher) withDetached(ctx context.Context) (context.Context, func() bool) {
+	w := &detached{d: d}
+	return context.WithValue(ctx, detachKey{}, w), func() bool {
+		return atomic.LoadInt64(&w.outstanding) > 0
+	}
+}
@@ -1,15 +1,20 @@
 package spinnaker
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
 )
 
 // Handler defines an interface to allow you to implement your own handlers
@@ -20,14 +25,150 @@ type Handler interface {
 	Name() string
 }
 
+// ContextHandler is a Handler that is given a context which is cancelled when
+// the handler times out or the webhook is abandoned. Handlers that make network
+// calls should implement it so those calls can be cancelled
+type ContextHandler interface {
+	HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error
+	Name() string
+}
+
+// AdaptHandler returns the given handler as a ContextHandler. Handlers that
+// don't implement ContextHandler are run in the background, and their result is
+// abandoned once the context is done since they can't be cancelled. They keep
+// running until they return and count as in flight until then (see Detach)
+func AdaptHandler(h Handler) ContextHandler {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch
+	}
+
+	return contextAdapter{h}
+}
+
+type contextAdapter struct {
+	Handler
+}
+
+func (a contextAdapter) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	done := make(chan error, 1)
+	release := Detach(ctx)
+	go func() {
+		defer release()
+
+		// The handler runs on its own goroutine, so panics have to be
+		// recovered here rather than by the dispatcher
+		defer func() {
+			if v := recover(); v != nil {
+				done <- &PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+
+		done <- a.Handle(incoming)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "handler abandoned")
+	}
+}
+
 // HandlerMap contains all of the handlers and the type of detail they are used for
 type HandlerMap map[string][]Handler
 
+// AnyHookType is the hook type of handlers that are called for every webhook,
+// after the handlers of its own hook type
+const AnyHookType = "*"
+
+// For returns the handlers called for the given hook type, including the ones
+// registered for AnyHookType
+func (hm HandlerMap) For(hookType string) []Handler {
+	if hookType == AnyHookType {
+		return hm[AnyHookType]
+	}
+
+	handlers := make([]Handler, 0, len(hm[hookType])+len(hm[AnyHookType]))
+	handlers = append(handlers, hm[hookType]...)
+
+	return append(handlers, hm[AnyHookType]...)
+}
+
 // Dispatcher contains all of the registered handlers for incoming webhooks
 // from Spinnaker based on their detail type. For example:
 // "orca:stage:complete"
 type Dispatcher struct {
-	handlers HandlerMap
+	// handlers holds a HandlerMap that is never modified once stored. Changes
+	// store a modified copy under mu so dispatching never has to take a lock
+	handlers atomic.Value
+	mu       sync.RWMutex
+
+	// inFlight tracks every handler that is currently running so they can be
+	// drained before shutting down
+	inFlight      sync.WaitGroup
+	inFlightCount int64
+	draining      int32
+
+	recorder telemetry.Recorder
+
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+
+	maxWebhookSize int64
+
+	panics *panicTracker
+	dedup  *deduplicator
+
+	middleware     []Middleware
+	hookMiddleware map[string][]Middleware
+}
+
+// DefaultHandlerTimeout is how long a handler may run before its context is
+// cancelled when no timeout is given to the dispatcher
+const DefaultHandlerTimeout = 10 * time.Second
+
+// DefaultMaxWebhookSize is the largest webhook body in bytes HandleIncomingRequest
+// reads when no limit is given to the dispatcher
+const DefaultMaxWebhookSize = 10 << 20
+
+// ErrWebhookTooLarge is returned by HandleIncomingRequest when the body of the
+// request is larger than the limit of the dispatcher
+var ErrWebhookTooLarge = errors.New("webhook is too large")
+
+// DispatcherOption configures optional behavior of a dispatcher
+type DispatcherOption func(*Dispatcher)
+
+// WithRecorder records every dispatch and handler result with the given recorder
+func WithRecorder(r telemetry.Recorder) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.recorder = r
+	}
+}
+
+// WithHandlerTimeout sets how long every handler may run before its context is
+// cancelled
+func WithHandlerTimeout(timeout time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.timeout = timeout
+	}
+}
+
+// WithHandlerTimeoutFor overrides the timeout of the handlers with the given
+// name. The name can be prefixed with a hook type, as in
+// "orca:stage:complete/DatadogEventHandler", to only override the timeout of the
+// handler registered for that hook type
+func WithHandlerTimeoutFor(name string, timeout time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.timeouts[name] = timeout
+	}
+}
+
+// WithMaxWebhookSize sets the largest webhook body in bytes HandleIncomingRequest
+// reads. Larger requests are rejected with ErrWebhookTooLarge
+func WithMaxWebhookSize(size int64) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.maxWebhookSize = size
+	}
 }
 
 // DispatchResult is returned from the webhook handler onto a channel
@@ -41,69 +182,344 @@ type DispatchResult struct {
 }
 
 // NewDispatcher initializes a new dispatcher instance
-func NewDispatcher() *Dispatcher {
-	return &Dispatcher{
-		handlers: make(HandlerMap),
+func NewDispatcher(opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		recorder: telemetry.Nop{},
+		timeout:  DefaultHandlerTimeout,
+		timeouts: make(map[string]time.Duration),
+		panics:   newPanicTracker(),
+
+		maxWebhookSize: DefaultMaxWebhookSize,
+
+		hookMiddleware: make(map[string][]Middleware),
+	}
+	d.handlers.Store(make(HandlerMap))
+
+	for _, opt := range opts {
+		opt(d)
 	}
+
+	return d
 }
 
-// Handlers returns the current handlers associated with this dispatcher
+// Handlers returns a snapshot of the handlers associated with this dispatcher.
+// The snapshot isn't affected by later changes and must not be modified
 func (d *Dispatcher) Handlers() HandlerMap {
-	return d.handlers
+	return d.handlers.Load().(HandlerMap)
 }
 
-// AddHandler adds a handler for the given hook type (orca:stage:complete for example)
+// AddHandler adds a handler for the given hook type (orca:stage:complete for
+// example), or for every webhook with AnyHookType. It is safe to call while
+// webhooks are being dispatched
 func (d *Dispatcher) AddHandler(hookType string, h Handler) {
-	if _, ok := d.handlers[hookType]; !ok {
-		d.handlers[hookType] = make([]Handler, 0)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	handlers := d.Handlers().copy()
+	handlers[hookType] = append(handlers[hookType], h)
+	d.handlers.Store(handlers)
+}
+
+// RemoveHandler removes the handlers with the given name from the given hook
+// type and returns how many were removed. Webhooks that are already being
+// dispatched still run the removed handlers
+func (d *Dispatcher) RemoveHandler(hookType, name string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	handlers := d.Handlers().copy()
+	var kept []Handler
+	for _, h := range handlers[hookType] {
+		if h.Name() != name {
+			kept = append(kept, h)
+		}
+	}
+
+	removed := len(handlers[hookType]) - len(kept)
+	if len(kept) == 0 {
+		delete(handlers, hookType)
+	} else {
+		handlers[hookType] = kept
 	}
+	d.handlers.Store(handlers)
 
-	d.handlers[hookType] = append(d.handlers[hookType], h)
+	return removed
+}
+
+// ReplaceHandlers replaces every handler of the dispatcher at once, for
+// example after reloading templates. Webhooks being dispatched either see all
+// of the old handlers or all of the new ones
+func (d *Dispatcher) ReplaceHandlers(handlers HandlerMap) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.handlers.Store(handlers.copy())
+}
+
+// copy returns a copy of the map whose slices can be appended to without
+// affecting the original
+func (hm HandlerMap) copy() HandlerMap {
+	c := make(HandlerMap, len(hm))
+	for hookType, handlers := range hm {
+		c[hookType] = append([]Handler(nil), handlers...)
+	}
+
+	return c
 }
 
 // HandleIncomingRequest reads a given http request object and dispatches the
 // appropriate handlers for it (if any exists). If it fails to decode the
-// incoming request body it will return an error. Otherwise, a channel is returned
+// incoming request body it will return an error, ErrWebhookTooLarge when the body
+// is larger than the limit of the dispatcher. Otherwise, a channel is returned
 // that results are sent to as the given handlers complete or fail.
+//
+// Handlers are given a context derived from the context of the request, see
+// Dispatch.
 func (d *Dispatcher) HandleIncomingRequest(req *http.Request) (<-chan DispatchResult, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, d.maxWebhookSize))
+	if err != nil {
+		d.recorder.WebhookDecodeFailed()
+
+		// The reader stops at exactly the limit when the body is larger
+		if int64(len(body)) >= d.maxWebhookSize {
+			return nil, ErrWebhookTooLarge
+		}
+		return nil, errors.Wrap(err, "could not read incoming webhook")
+	}
+
+	return d.DispatchJSON(req.Context(), body)
+}
+
+// DispatchJSON decodes a webhook in the JSON format Spinnaker sends and
+// dispatches it like Dispatch does. It returns an error if the webhook can't be
+// decoded. The body is kept as the Raw payload of the webhook, so it must not
+// be modified afterwards.
+func (d *Dispatcher) DispatchJSON(ctx context.Context, body []byte) (<-chan DispatchResult, error) {
 	incoming := new(types.IncomingWebhook)
 
-	if err := json.NewDecoder(req.Body).Decode(incoming); err != nil {
+	if err := json.Unmarshal(body, incoming); err != nil {
+		d.recorder.WebhookDecodeFailed()
 		return nil, errors.Wrap(err, "could not decode incoming webhook")
 	}
+	incoming.Raw = body
+
+	return d.Dispatch(ctx, incoming), nil
+}
+
+// Dispatch runs the handlers of the given webhook's type and returns a channel
+// that results are sent to as the handlers complete or fail. The channel is
+// closed once every handler has finished.
+//
+// Handlers are given a context derived from the given context, which is
+// cancelled once their timeout elapses. The results channel is buffered so
+// handlers never block if the caller stops reading from it.
+//
+// Handlers run phase by phase (see Phase). Handlers of earlier phases may
+// modify the incoming webhook or set annotations (see AnnotationsFrom) that
+// handlers of later phases read, even if they fail.
+func (d *Dispatcher) Dispatch(ctx context.Context, incoming *types.IncomingWebhook) <-chan DispatchResult {
+	var key string
+	var succeeded map[string]bool
+	if d.dedup != nil {
+		key = dedupKey(incoming)
+		var seen bool
+		if key != "" {
+			succeeded, seen = d.dedup.seen(key)
+		}
+		if seen {
+			logrus.WithFields(logrus.Fields{
+				"hook_type":    incoming.Details.Type,
+				"execution_id": incoming.Content.ExecutionID,
+			}).Debug("dropping duplicate webhook")
+			d.recorder.WebhookDuplicate(incoming.Details.Type)
+
+			results := make(chan DispatchResult)
+			close(results)
+			return results
+		}
+	}
+
+	byPhase := make(map[Phase][]namedHandler)
+	var total int
+	for _, handler := range d.Handlers().For(incoming.Details.Type) {
+		name := handler.Name()
+		if d.panics.isDisabled(handlerKey(incoming.Details.Type, name)) {
+			logrus.WithField("handler", name).Debug("skipping disabled handler")
+			continue
+		}
+		if succeeded[name] {
+			logrus.WithField("handler", name).Debug("skipping handler that already succeeded for webhook")
+			continue
+		}
+
+		phase := phaseOf(handler)
+		byPhase[phase] = append(byPhase[phase], namedHandler{
+			Handler: d.wrap(incoming.Details.Type, handler),
+			name:    name,
+		})
+		total++
+	}
 
-	handlers := d.Handlers()[incoming.Details.Type]
 	logrus.WithFields(logrus.Fields{
 		"hook_type": incoming.Details.Type,
-		"handlers":  len(handlers),
+		"handlers":  total,
 	}).Debug("dispatch called")
+	d.recorder.WebhookDispatched(incoming.Details.Type, total)
+
+	// Handlers waiting for an earlier phase count as in flight so draining
+	// waits for them as well
+	d.inFlight.Add(total)
+	d.recorder.HandlersInFlight(int(atomic.AddInt64(&d.inFlightCount, int64(total))))
+
+	ctx = withAnnotations(ctx)
+	results := make(chan DispatchResult, total)
+	go func() {
+		var mu sync.Mutex
+		var failed bool
+		var handled []string
+		for _, phase := range []Phase{PhaseEnrich, PhaseTransform, PhaseEmit} {
+			var wg sync.WaitGroup
+			wg.Add(len(byPhase[phase]))
+			for _, handler := range byPhase[phase] {
+				go func(handler namedHandler) {
+					result := d.run(ctx, incoming, handler)
+					mu.Lock()
+					if result.Err != nil {
+						failed = true
+					} else {
+						handled = append(handled, result.HandlerName)
+					}
+					mu.Unlock()
+					results <- result
+					wg.Done()
+				}(handler)
+			}
+			wg.Wait()
+		}
+
+		// Echo's retries of webhooks whose handlers failed aren't dropped as
+		// duplicates, but only run the handlers that didn't succeed
+		if key != "" && failed {
+			d.dedup.failed(key, handled)
+		}
+
+		// Once we've processed all of our handlers we're going to close the
+		// channel so receivers can act accordingly
+		close(results)
+	}()
 
-	var wg sync.WaitGroup
-	wg.Add(len(handlers))
-
-	results := make(chan DispatchResult)
-	for _, handler := range handlers {
-		go func(handler Handler) {
-			start := time.Now()
-			err := handler.Handle(incoming)
-			took := time.Since(start)
-			results <- DispatchResult{
-				Err:         err,
-				HandlerName: handler.Name(),
-				HookType:    incoming.Details.Type,
-				Duration:    took,
+	return results
+}
+
+// run calls the given handler with its timeout and records its result
+func (d *Dispatcher) run(ctx context.Context, incoming *types.IncomingWebhook, handler namedHandler) DispatchResult {
+	name := handler.name
+	ctx, cancel := context.WithTimeout(ctx, d.HandlerTimeout(incoming.Details.Type, name))
+	defer cancel()
+	ctx, detachedRunning := d.withDetached(ctx)
+
+	start := time.Now()
+	err := safeHandle(ctx, AdaptHandler(handler.Handler), incoming)
+	took := time.Since(start)
+	d.recorder.HandlersInFlight(int(atomic.AddInt64(&d.inFlightCount, -1)))
+	d.inFlight.Done()
+
+	if detachedRunning() {
+		logrus.WithField("handler", name).Warn("handler abandoned work that is still running")
+		d.recorder.HandlerAbandoned(incoming.Details.Type, name)
+	}
+
+	if _, ok := err.(*PanicError); ok {
+		logrus.WithError(err).WithField("handler", name).Error("handler panicked")
+		d.recorder.HandlerPanicked(incoming.Details.Type, name)
+		d.panics.record(handlerKey(incoming.Details.Type, name))
+	}
+	d.recorder.HandlerCompleted(incoming.Details.Type, name, took, err)
+
+	return DispatchResult{
+		Err:         err,
+		HandlerName: name,
+		HookType:    incoming.Details.Type,
+		Duration:    took,
+	}
+}
+
+// namedHandler is a handler, wrapped in its middleware, along with its name so
+// Name is only called once per dispatch
+type namedHandler struct {
+	Handler
+	name string
+}
+
+// HandlerTimeout returns the timeout of the handler with the given name
+// registered for the given hook type
+func (d *Dispatcher) HandlerTimeout(hookType, name string) time.Duration {
+	if timeout, ok := d.timeouts[handlerKey(hookType, name)]; ok {
+		return timeout
+	}
+	if timeout, ok := d.timeouts[name]; ok {
+		return timeout
+	}
+
+	return d.timeout
+}
+
+// WebhookTimeout returns how long dispatching a webhook may take at most with
+// the current handlers: the longest handler timeout of every phase, added up,
+// for the hook type whose handlers take the longest
+func (d *Dispatcher) WebhookTimeout() time.Duration {
+	handlers := d.Handlers()
+
+	var longest time.Duration
+	for hookType := range handlers {
+		perPhase := make(map[Phase]time.Duration)
+		for _, handler := range handlers.For(hookType) {
+			phase := phaseOf(handler)
+			if timeout := d.HandlerTimeout(hookType, handler.Name()); timeout > perPhase[phase] {
+				perPhase[phase] = timeout
 			}
+		}
 
-			wg.Done()
-		}(handler)
+		var total time.Duration
+		for _, timeout := range perPhase {
+			total += timeout
+		}
+		if total > longest {
+			longest = total
+		}
 	}
 
-	// Once we've processed all of our handlers we're going to close the channel
-	// so receivers can act accordingly
+	return longest
+}
+
+// InFlight returns how many handlers are currently running
+func (d *Dispatcher) InFlight() int {
+	return int(atomic.LoadInt64(&d.inFlightCount))
+}
+
+// Draining returns whether Drain has been called, after which the dispatcher
+// shouldn't be sent new webhooks
+func (d *Dispatcher) Draining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// Drain blocks until every handler that has been dispatched has finished,
+// including work they abandoned (see Detach), or the given context is done. It
+// should only be called once no new webhooks are being dispatched, for example
+// after the server has been shut down.
+func (d *Dispatcher) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&d.draining, 1)
+
+	drained := make(chan struct{})
 	go func() {
-		wg.Wait()
-		close(results)
+		d.inFlight.Wait()
+		close(drained)
 	}()
 
-	return results, nil
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "could not drain dispatcher")
+	}
 }
@@ -1,9 +1,13 @@
 package spinnaker_test
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -16,6 +20,7 @@ import (
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/mocks"
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
 )
 
 func TestDispatcherAddsHandlers(t *testing.T) {
@@ -26,6 +31,62 @@ func TestDispatcherAddsHandlers(t *testing.T) {
 	assert.Len(t, d.Handlers(), 1)
 }
 
+func TestDispatcherRemovesHandlers(t *testing.T) {
+	noop := func(ctx context.Context, incoming *types.IncomingWebhook) error { return nil }
+
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("test", spinnaker.HandlerFunc("first", noop))
+	d.AddHandler("test", spinnaker.HandlerFunc("second", noop))
+	snapshot := d.Handlers()
+
+	assert.Equal(t, 1, d.RemoveHandler("test", "first"))
+	assert.Equal(t, 0, d.RemoveHandler("test", "first"))
+	require.Len(t, d.Handlers()["test"], 1)
+	assert.Equal(t, "second", d.Handlers()["test"][0].Name())
+	assert.Len(t, snapshot["test"], 2, "snapshots should not change")
+
+	assert.Equal(t, 1, d.RemoveHandler("test", "second"))
+	assert.Empty(t, d.Handlers())
+}
+
+func TestDispatcherReplacesHandlers(t *testing.T) {
+	noop := func(ctx context.Context, incoming *types.IncomingWebhook) error { return nil }
+
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("test", spinnaker.HandlerFunc("old", noop))
+	d.ReplaceHandlers(spinnaker.HandlerMap{
+		"orca:stage:complete": {spinnaker.HandlerFunc("new", noop)},
+	})
+
+	handlers := d.Handlers()
+	assert.NotContains(t, handlers, "test")
+	require.Len(t, handlers["orca:stage:complete"], 1)
+	assert.Equal(t, "new", handlers["orca:stage:complete"][0].Name())
+}
+
+func TestDispatcherRegistersHandlersWhileDispatching(t *testing.T) {
+	noop := func(ctx context.Context, incoming *types.IncomingWebhook) error { return nil }
+	d := spinnaker.NewDispatcher()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", noop))
+			d.RemoveHandler("orca:stage:complete", "handler")
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+		require.NoError(t, err)
+		for result := range results {
+			assert.NoError(t, result.Err)
+		}
+	}
+	<-done
+}
+
 func TestDispatcherHandlesRequests(t *testing.T) {
 	tests := []handlerTest{
 		{
@@ -181,3 +242,340 @@ func defaultMockFactory(ctrl *gomock.Controller, t *testing.T) *mocks.MockHandle
 	m := mocks.NewMockHandler(ctrl)
 	return m
 }
+
+func TestDispatcherRejectsLargeWebhooks(t *testing.T) {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "valid-webhook.json"))
+	require.NoError(t, err)
+
+	d := spinnaker.NewDispatcher(spinnaker.WithMaxWebhookSize(int64(len(body))))
+	d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		return nil
+	}))
+
+	t.Run("Given a webhook within the limit", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		_, err := d.HandleIncomingRequest(req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Given a webhook over the limit", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(append(body, ' ')))
+		_, err := d.HandleIncomingRequest(req)
+		assert.Equal(t, spinnaker.ErrWebhookTooLarge, err)
+	})
+}
+
+func TestDispatcherDrainsHandlers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	release := make(chan struct{})
+	m := mocks.NewMockHandler(ctrl)
+	m.EXPECT().Handle(gomock.Any()).Do(func(incoming *types.IncomingWebhook) {
+		<-release
+	})
+	m.EXPECT().Name().Return("MockHandler")
+
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("orca:stage:complete", m)
+
+	results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+	require.NoError(t, err)
+
+	assert.False(t, d.Draining())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	require.Error(t, d.Drain(ctx), "drained while a handler was still running")
+	assert.True(t, d.Draining())
+
+	close(release)
+	require.NoError(t, d.Drain(context.Background()))
+	<-results
+}
+
+type contextHandler struct {
+	name string
+}
+
+func (h *contextHandler) Name() string { return h.name }
+
+func (h *contextHandler) Handle(incoming *types.IncomingWebhook) error {
+	return h.HandleContext(context.Background(), incoming)
+}
+
+func (h *contextHandler) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDispatcherCancelsHandlersAfterTimeout(t *testing.T) {
+	t.Run("Given a context aware handler", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(
+			spinnaker.WithHandlerTimeout(time.Hour),
+			spinnaker.WithHandlerTimeoutFor("slow", time.Millisecond*10),
+		)
+		d.AddHandler("orca:stage:complete", &contextHandler{name: "slow"})
+
+		results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+		require.NoError(t, err)
+
+		select {
+		case result := <-results:
+			require.Error(t, result.Err)
+			assert.Equal(t, context.DeadlineExceeded, result.Err)
+		case <-time.After(time.Millisecond * 100):
+			t.Error("handler was never cancelled")
+		}
+	})
+
+	t.Run("Given a handler that isn't context aware", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		release := make(chan struct{})
+		defer close(release)
+
+		m := mocks.NewMockHandler(ctrl)
+		m.EXPECT().Handle(gomock.Any()).Do(func(incoming *types.IncomingWebhook) {
+			<-release
+		})
+		m.EXPECT().Name().Return("MockHandler")
+
+		d := spinnaker.NewDispatcher(spinnaker.WithHandlerTimeout(time.Millisecond * 10))
+		d.AddHandler("orca:stage:complete", m)
+
+		results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+		require.NoError(t, err)
+
+		select {
+		case result := <-results:
+			require.Error(t, result.Err)
+		case <-time.After(time.Millisecond * 100):
+			t.Error("handler was never abandoned")
+		}
+	})
+}
+
+type abandonRecorder struct {
+	telemetry.Nop
+	abandoned chan string
+}
+
+func (r *abandonRecorder) HandlerAbandoned(hookType, handler string) {
+	r.abandoned <- handler
+}
+
+func TestDispatcherDrainsAbandonedHandlers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	release := make(chan struct{})
+	m := mocks.NewMockHandler(ctrl)
+	m.EXPECT().Handle(gomock.Any()).Do(func(incoming *types.IncomingWebhook) {
+		<-release
+	})
+	m.EXPECT().Name().Return("MockHandler")
+
+	recorder := &abandonRecorder{abandoned: make(chan string, 1)}
+	d := spinnaker.NewDispatcher(
+		spinnaker.WithHandlerTimeout(time.Millisecond*10),
+		spinnaker.WithRecorder(recorder),
+	)
+	d.AddHandler("orca:stage:complete", m)
+
+	results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+	require.NoError(t, err)
+	require.Error(t, (<-results).Err)
+
+	select {
+	case handler := <-recorder.abandoned:
+		assert.Equal(t, "MockHandler", handler)
+	case <-time.After(time.Millisecond * 100):
+		t.Error("abandoned handler was never recorded")
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer drainCancel()
+	assert.Error(t, d.Drain(drainCtx), "drain returned while the abandoned handler was running")
+
+	close(release)
+	drainCtx, drainCancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer drainCancel()
+	assert.NoError(t, d.Drain(drainCtx))
+}
+
+func TestDispatcherTimesOutHandlersByHookType(t *testing.T) {
+	d := spinnaker.NewDispatcher(
+		spinnaker.WithHandlerTimeout(time.Hour),
+		spinnaker.WithHandlerTimeoutFor("orca:stage:complete/slow", time.Millisecond*10),
+	)
+	d.AddHandler("orca:stage:complete", &contextHandler{name: "slow"})
+	d.AddHandler("orca:task:complete", &contextHandler{name: "slow"})
+
+	select {
+	case result := <-d.Dispatch(context.Background(), &types.IncomingWebhook{Details: types.Details{Type: "orca:stage:complete"}}):
+		assert.Equal(t, context.DeadlineExceeded, result.Err)
+	case <-time.After(time.Millisecond * 100):
+		t.Error("handler was never cancelled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	select {
+	case <-d.Dispatch(ctx, &types.IncomingWebhook{Details: types.Details{Type: "orca:task:complete"}}):
+		t.Error("handler for another hook type was cancelled by the override")
+	case <-time.After(time.Millisecond * 30):
+	}
+}
+
+func TestDispatcherDoesNotBlockOnUnreadResults(t *testing.T) {
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("orca:stage:complete", &contextHandler{name: "first"})
+	d.AddHandler("orca:stage:complete", &contextHandler{name: "second"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := requestFromFile("valid-webhook.json").WithContext(ctx)
+	_, err := d.HandleIncomingRequest(req)
+	require.NoError(t, err)
+	cancel()
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer drainCancel()
+	require.NoError(t, d.Drain(drainCtx))
+}
+
+type panickingHandler struct {
+	name string
+}
+
+func (h *panickingHandler) Name() string { return h.name }
+
+func (h *panickingHandler) Handle(incoming *types.IncomingWebhook) error {
+	panic("boom")
+}
+
+func TestDispatcherRecoversPanics(t *testing.T) {
+	t.Run("Given a panicking handler", func(t *testing.T) {
+		d := spinnaker.NewDispatcher()
+		d.AddHandler("orca:stage:complete", &panickingHandler{name: "panicky"})
+
+		results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+		require.NoError(t, err)
+
+		result := <-results
+		require.Error(t, result.Err)
+		perr, ok := result.Err.(*spinnaker.PanicError)
+		require.True(t, ok, "expected a *PanicError, got %T", result.Err)
+		assert.Equal(t, "boom", perr.Value)
+		assert.NotEmpty(t, perr.Stack)
+	})
+
+	t.Run("Given a panicking context aware handler", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithPanicLimit(1, time.Minute))
+		d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("panicky", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+			panic("boom")
+		}))
+
+		results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+		require.NoError(t, err)
+
+		result := <-results
+		perr, ok := result.Err.(*spinnaker.PanicError)
+		require.True(t, ok, "expected a *PanicError, got %T", result.Err)
+		assert.Equal(t, "boom", perr.Value)
+		assert.NotEmpty(t, perr.Stack)
+		_, more := <-results
+		assert.False(t, more)
+		assert.Equal(t, []string{"orca:stage:complete/panicky"}, d.DisabledHandlers())
+	})
+
+	t.Run("Given a handler that keeps panicking", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithPanicLimit(2, time.Minute))
+		d.AddHandler("orca:stage:complete", &panickingHandler{name: "panicky"})
+
+		for i := 0; i < 2; i++ {
+			results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+			require.NoError(t, err)
+			for range results {
+			}
+		}
+		assert.Equal(t, []string{"orca:stage:complete/panicky"}, d.DisabledHandlers())
+
+		results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+		require.NoError(t, err)
+		_, ok := <-results
+		assert.False(t, ok, "disabled handler should not run")
+
+		d.EnableHandler("orca:stage:complete", "panicky")
+		assert.Empty(t, d.DisabledHandlers())
+	})
+
+	t.Run("Given a handler that keeps panicking for one hook type", func(t *testing.T) {
+		d := spinnaker.NewDispatcher(spinnaker.WithPanicLimit(1, time.Minute))
+		panicky := &panickingHandler{name: "panicky"}
+		d.AddHandler("orca:stage:complete", panicky)
+		d.AddHandler("orca:task:complete", panicky)
+
+		for range d.Dispatch(context.Background(), &types.IncomingWebhook{Details: types.Details{Type: "orca:stage:complete"}}) {
+		}
+
+		result, ok := <-d.Dispatch(context.Background(), &types.IncomingWebhook{Details: types.Details{Type: "orca:task:complete"}})
+		require.True(t, ok, "handler should still run for other hook types")
+		assert.IsType(t, &spinnaker.PanicError{}, result.Err)
+	})
+}
+
+func TestDispatcherDispatchesWithoutRequests(t *testing.T) {
+	var handled *types.IncomingWebhook
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		handled = incoming
+		return nil
+	}))
+
+	t.Run("Given a decoded webhook", func(t *testing.T) {
+		incoming := &types.IncomingWebhook{Details: types.Details{Type: "orca:stage:complete"}}
+
+		result := <-d.Dispatch(context.Background(), incoming)
+		require.NoError(t, result.Err)
+		assert.Equal(t, "handler", result.HandlerName)
+		assert.Equal(t, incoming, handled)
+	})
+
+	t.Run("Given a JSON webhook", func(t *testing.T) {
+		body := []byte(`{"details": {"type": "orca:stage:complete", "application": "hcm"}}`)
+		results, err := d.DispatchJSON(context.Background(), body)
+		require.NoError(t, err)
+
+		result := <-results
+		require.NoError(t, result.Err)
+		assert.Equal(t, "hcm", handled.Details.Application)
+		assert.Equal(t, body, []byte(handled.Raw))
+	})
+
+	t.Run("Given invalid JSON", func(t *testing.T) {
+		_, err := d.DispatchJSON(context.Background(), []byte(`{`))
+		assert.Error(t, err)
+	})
+}
+
+func TestDispatcherDispatchesEveryHookTypeToAnyHookType(t *testing.T) {
+	noop := func(ctx context.Context, incoming *types.IncomingWebhook) error { return nil }
+
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("stage", noop))
+	d.AddHandler(spinnaker.AnyHookType, spinnaker.HandlerFunc("any", noop))
+
+	names := func(hookType string) []string {
+		var names []string
+		for result := range d.Dispatch(context.Background(), &types.IncomingWebhook{Details: types.Details{Type: hookType}}) {
+			assert.NoError(t, result.Err)
+			names = append(names, result.HandlerName)
+		}
+		return names
+	}
+
+	assert.ElementsMatch(t, []string{"stage", "any"}, names("orca:stage:complete"))
+	assert.Equal(t, []string{"any"}, names("orca:pipeline:starting"))
+	assert.Len(t, d.Handlers()["orca:stage:complete"], 1, "dispatching should not change the handlers")
+}
@@ -0,0 +1,281 @@
+package spinnaker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// DefaultEnrichmentTTL is how long application and pipeline configurations
+// are cached when no TTL is given to NewEnricher
+const DefaultEnrichmentTTL = 5 * time.Minute
+
+// DefaultEnrichmentFailureTTL is how long failed lookups are cached when no
+// failure TTL is given to NewEnricher
+const DefaultEnrichmentFailureTTL = 30 * time.Second
+
+// Enricher looks up application and pipeline configuration from Spinnaker's
+// Gate API for incoming webhooks. Results are cached for a TTL so every
+// webhook doesn't result in a call to Gate. Failed lookups are cached for a
+// shorter TTL so webhooks don't all wait on Gate while it is down, and
+// concurrent lookups of the same configuration share a single call.
+type Enricher struct {
+	baseURL    string
+	client     *http.Client
+	ttl        time.Duration
+	failureTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+	calls map[string]*lookupCall
+	now   func() time.Time
+}
+
+// cacheEntry is the result of a lookup, either its value or its error
+type cacheEntry struct {
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// lookupCall is a lookup in progress that concurrent lookups wait for.
+// Abandoned is set when its caller gave up, in which case its result isn't
+// shared
+type lookupCall struct {
+	done      chan struct{}
+	entry     cacheEntry
+	abandoned bool
+}
+
+// EnricherOption configures optional behavior of an enricher
+type EnricherOption func(*Enricher)
+
+// WithFailureTTL sets how long failed lookups are cached before Gate is
+// called again
+func WithFailureTTL(ttl time.Duration) EnricherOption {
+	return func(e *Enricher) {
+		e.failureTTL = ttl
+	}
+}
+
+// NewEnricher initializes an enricher that queries the Gate API located at
+// baseURL (https://gate.example.com for example)
+func NewEnricher(baseURL string, ttl time.Duration, opts ...EnricherOption) *Enricher {
+	if ttl <= 0 {
+		ttl = DefaultEnrichmentTTL
+	}
+
+	e := &Enricher{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		client:     &http.Client{Timeout: 5 * time.Second},
+		ttl:        ttl,
+		failureTTL: DefaultEnrichmentFailureTTL,
+		cache:      make(map[string]cacheEntry),
+		calls:      make(map[string]*lookupCall),
+		now:        time.Now,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
+
+// Enrich returns the application and pipeline configuration for the given
+// webhook. The pipeline is looked up by the PipelineConfigID of the execution
+// and is left empty if the webhook isn't for a pipeline execution.
+func (e *Enricher) Enrich(incoming *types.IncomingWebhook) (types.Enrichment, error) {
+	return e.EnrichContext(context.Background(), incoming)
+}
+
+// EnrichContext is like Enrich, but calls to Gate are cancelled once the given
+// context is done
+func (e *Enricher) EnrichContext(ctx context.Context, incoming *types.IncomingWebhook) (types.Enrichment, error) {
+	enrichment := types.Enrichment{Attempted: true}
+
+	app := incoming.Application()
+	if app == "" {
+		return enrichment, nil
+	}
+
+	application, err := e.application(ctx, app)
+	if err != nil {
+		return enrichment, err
+	}
+	enrichment.Application = application
+
+	if id := incoming.Content.Execution.PipelineConfigID; id != "" {
+		pipeline, err := e.pipeline(ctx, app, id)
+		if err != nil {
+			return enrichment, err
+		}
+		enrichment.Pipeline = pipeline
+	}
+
+	return enrichment, nil
+}
+
+// Application returns the configuration for the given application name
+func (e *Enricher) Application(name string) (types.Application, error) {
+	return e.application(context.Background(), name)
+}
+
+func (e *Enricher) application(ctx context.Context, name string) (types.Application, error) {
+	v, err := e.lookup(ctx, "application/"+name, func(ctx context.Context) (interface{}, error) {
+		return e.fetchApplication(ctx, name)
+	})
+	if err != nil {
+		return types.Application{}, err
+	}
+
+	return v.(types.Application), nil
+}
+
+func (e *Enricher) fetchApplication(ctx context.Context, name string) (types.Application, error) {
+	var resp struct {
+		Name       string                 `json:"name"`
+		Attributes map[string]interface{} `json:"attributes"`
+	}
+	if err := e.get(ctx, fmt.Sprintf("/applications/%s", url.PathEscape(name)), &resp); err != nil {
+		return types.Application{}, errors.Wrapf(err, "could not fetch application %q", name)
+	}
+
+	// Attributes are decoded twice: once into the typed fields and once as a
+	// raw map so custom attributes stay reachable from templates
+	var application types.Application
+	b, err := json.Marshal(resp.Attributes)
+	if err != nil {
+		return types.Application{}, errors.Wrap(err, "could not encode application attributes")
+	}
+	if err := json.Unmarshal(b, &application); err != nil {
+		return types.Application{}, errors.Wrap(err, "could not decode application attributes")
+	}
+	if application.Name == "" {
+		application.Name = resp.Name
+	}
+	application.Attributes = resp.Attributes
+
+	return application, nil
+}
+
+// Pipeline returns the configuration of the pipeline with the given ID that
+// belongs to the given application. All of the application's pipeline
+// configurations are fetched and cached at once.
+func (e *Enricher) Pipeline(app, id string) (types.Pipeline, error) {
+	return e.pipeline(context.Background(), app, id)
+}
+
+func (e *Enricher) pipeline(ctx context.Context, app, id string) (types.Pipeline, error) {
+	v, err := e.lookup(ctx, "pipelines/"+app, func(ctx context.Context) (interface{}, error) {
+		var configs []types.Pipeline
+		if err := e.get(ctx, fmt.Sprintf("/applications/%s/pipelineConfigs", url.PathEscape(app)), &configs); err != nil {
+			return nil, errors.Wrapf(err, "could not fetch pipeline configs for %q", app)
+		}
+
+		pipelines := make(map[string]types.Pipeline, len(configs))
+		for _, config := range configs {
+			pipelines[config.ID] = config
+		}
+		return pipelines, nil
+	})
+	if err != nil {
+		return types.Pipeline{}, err
+	}
+
+	pipeline, ok := v.(map[string]types.Pipeline)[id]
+	if !ok {
+		return types.Pipeline{}, errors.Errorf("pipeline config %q not found for %q", id, app)
+	}
+
+	return pipeline, nil
+}
+
+// lookup returns the cached result of the given key, or calls fetch and caches
+// its result. Concurrent lookups of a key that isn't cached wait for the same
+// call to fetch rather than making their own, or for their context to be done
+func (e *Enricher) lookup(ctx context.Context, key string, fetch func(context.Context) (interface{}, error)) (interface{}, error) {
+	e.mu.Lock()
+	if entry, ok := e.cache[key]; ok && e.now().Before(entry.expires) {
+		e.mu.Unlock()
+		return entry.value, entry.err
+	}
+	call, ok := e.calls[key]
+	if !ok {
+		call = &lookupCall{done: make(chan struct{})}
+		e.calls[key] = call
+	}
+	e.mu.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+			if call.abandoned {
+				return e.lookup(ctx, key, fetch)
+			}
+			return call.entry.value, call.entry.err
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "gave up waiting for gate")
+		}
+	}
+
+	value, err := fetch(ctx)
+	call.entry = cacheEntry{value: value, err: err, expires: e.now().Add(e.ttl)}
+	if err != nil {
+		call.entry.expires = e.now().Add(e.failureTTL)
+	}
+
+	e.mu.Lock()
+	delete(e.calls, key)
+	// A lookup that failed because its caller gave up says nothing about
+	// Gate, so it isn't cached
+	if err == nil || ctx.Err() == nil {
+		e.cache[key] = call.entry
+	} else {
+		call.abandoned = true
+	}
+	e.mu.Unlock()
+	close(call.done)
+
+	return value, err
+}
+
+func (e *Enricher) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, e.baseURL+path, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not create request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not reach gate")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status code from gate: %d", resp.StatusCode)
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "could not decode gate response")
+}
+
+// Handler returns a handler that enriches webhooks in PhaseEnrich, so every
+// handler of the later phases can read their Enrichment. Webhooks are still
+// dispatched to the later phases when enrichment fails.
+func (e *Enricher) Handler() Handler {
+	return InPhase(PhaseEnrich, HandlerFunc("Enricher", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		enrichment, err := e.EnrichContext(ctx, incoming)
+		incoming.Enrichment = enrichment
+		return err
+	}))
+}
@@ -0,0 +1,132 @@
+package spinnaker_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+func newGateServer(calls map[string]int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/applications/hcm", func(w http.ResponseWriter, req *http.Request) {
+		calls[req.URL.Path]++
+		w.Write([]byte(`{"name":"hcm","attributes":{"name":"hcm","email":"team@email.com","repoProjectKey":"namely","repoSlug":"hcm","team":"payroll"}}`))
+	})
+	mux.HandleFunc("/applications/hcm/pipelineConfigs", func(w http.ResponseWriter, req *http.Request) {
+		calls[req.URL.Path]++
+		w.Write([]byte(`[{"id":"c6f20df7-f9ab-45b5-b525-9a67ef2e95b5","name":"Deploy to production","application":"hcm"}]`))
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestEnricherEnrichesWebhooks(t *testing.T) {
+	calls := make(map[string]int)
+	ts := newGateServer(calls)
+	defer ts.Close()
+
+	e := spinnaker.NewEnricher(ts.URL, time.Minute)
+	incoming := &types.IncomingWebhook{
+		Details: types.Details{Application: "hcm"},
+		Content: types.Content{
+			Execution: types.Execution{PipelineConfigID: "c6f20df7-f9ab-45b5-b525-9a67ef2e95b5"},
+		},
+	}
+
+	enrichment, err := e.Enrich(incoming)
+	require.NoError(t, err)
+	assert.Equal(t, "team@email.com", enrichment.Application.Email)
+	assert.Equal(t, "namely", enrichment.Application.RepoProjectKey)
+	assert.Equal(t, "payroll", enrichment.Application.Attribute("team"))
+	assert.Equal(t, "Deploy to production", enrichment.Pipeline.Name)
+
+	t.Run("Results are cached", func(t *testing.T) {
+		_, err := e.Enrich(incoming)
+		require.NoError(t, err)
+		assert.Equal(t, 1, calls["/applications/hcm"])
+		assert.Equal(t, 1, calls["/applications/hcm/pipelineConfigs"])
+	})
+}
+
+func TestEnricherErrors(t *testing.T) {
+	calls := make(map[string]int)
+	ts := newGateServer(calls)
+	defer ts.Close()
+
+	e := spinnaker.NewEnricher(ts.URL, time.Minute)
+
+	t.Run("Given an unknown application", func(t *testing.T) {
+		_, err := e.Enrich(&types.IncomingWebhook{Details: types.Details{Application: "nope"}})
+		require.Error(t, err)
+	})
+
+	t.Run("Given an unknown pipeline", func(t *testing.T) {
+		enrichment, err := e.Enrich(&types.IncomingWebhook{
+			Details: types.Details{Application: "hcm"},
+			Content: types.Content{Execution: types.Execution{PipelineConfigID: "nope"}},
+		})
+		require.Error(t, err)
+		assert.Equal(t, "hcm", enrichment.Application.Name)
+	})
+}
+
+func TestEnricherCachesFailures(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	e := spinnaker.NewEnricher(ts.URL, time.Minute, spinnaker.WithFailureTTL(50*time.Millisecond))
+	incoming := &types.IncomingWebhook{Details: types.Details{Application: "hcm"}}
+
+	for i := 0; i < 3; i++ {
+		_, err := e.Enrich(incoming)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "failures should be cached")
+
+	time.Sleep(100 * time.Millisecond)
+	_, err := e.Enrich(incoming)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "failures should expire")
+}
+
+func TestEnricherSharesConcurrentLookups(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte(`{"name":"hcm","attributes":{"email":"team@email.com"}}`))
+	}))
+	defer ts.Close()
+
+	e := spinnaker.NewEnricher(ts.URL, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			application, err := e.Application("hcm")
+			assert.NoError(t, err)
+			assert.Equal(t, "team@email.com", application.Email)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,14 @@
+package spinnaker
+
+import "path"
+
+// MatchGlob reports whether s matches the glob pattern (see path.Match). An
+// empty pattern matches everything and an invalid one matches nothing
+func MatchGlob(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
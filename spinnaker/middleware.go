@@ -0,0 +1,89 @@
+package spinnaker
+
+import (
+	"context"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// Middleware wraps a handler to add behavior around it, such as auditing or
+// filtering. Middleware that should keep the handler cancellable has to return
+// a ContextHandler, HandlerFunc makes that easy:
+//
+//	func(next spinnaker.Handler) spinnaker.Handler {
+//		h := spinnaker.AdaptHandler(next)
+//		return spinnaker.HandlerFunc(next.Name(), func(ctx context.Context, incoming *types.IncomingWebhook) error {
+//			log.Println("handling", incoming.Details.Type)
+//			return h.HandleContext(ctx, incoming)
+//		})
+//	}
+type Middleware func(Handler) Handler
+
+// Use registers middleware that wraps the handlers of every hook type.
+// Middleware registered first is the outermost
+func (d *Dispatcher) Use(mw ...Middleware) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.middleware = append(d.middleware, mw...)
+}
+
+// UseFor registers middleware that only wraps the handlers of the given hook
+// type. It runs inside the middleware registered with Use
+func (d *Dispatcher) UseFor(hookType string, mw ...Middleware) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.hookMiddleware[hookType] = append(d.hookMiddleware[hookType], mw...)
+}
+
+// wrap applies the global and hook type middleware to the given handler
+func (d *Dispatcher) wrap(hookType string, h Handler) Handler {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	hookMiddleware := d.hookMiddleware[hookType]
+	for i := len(hookMiddleware) - 1; i >= 0; i-- {
+		h = hookMiddleware[i](h)
+	}
+	for i := len(d.middleware) - 1; i >= 0; i-- {
+		h = d.middleware[i](h)
+	}
+
+	return h
+}
+
+// HandlerFunc returns a handler with the given name that calls fn
+func HandlerFunc(name string, fn func(ctx context.Context, incoming *types.IncomingWebhook) error) Handler {
+	return funcHandler{name: name, fn: fn}
+}
+
+type funcHandler struct {
+	name string
+	fn   func(ctx context.Context, incoming *types.IncomingWebhook) error
+}
+
+func (h funcHandler) Name() string { return h.name }
+
+func (h funcHandler) Handle(incoming *types.IncomingWebhook) error {
+	return h.fn(context.Background(), incoming)
+}
+
+func (h funcHandler) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	return h.fn(ctx, incoming)
+}
+
+// Filter is middleware that only runs the handler for webhooks the given
+// function accepts. Other webhooks are skipped without an error
+func Filter(accept func(incoming *types.IncomingWebhook) bool) Middleware {
+	return func(next Handler) Handler {
+		h := AdaptHandler(next)
+		return HandlerFunc(next.Name(), func(ctx context.Context, incoming *types.IncomingWebhook) error {
+			if !accept(incoming) {
+				return nil
+			}
+
+			return h.HandleContext(ctx, incoming)
+		})
+	}
+}
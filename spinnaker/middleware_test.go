@@ -0,0 +1,82 @@
+package spinnaker_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+func TestDispatcherAppliesMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+
+	named := func(label string) spinnaker.Middleware {
+		return func(next spinnaker.Handler) spinnaker.Handler {
+			h := spinnaker.AdaptHandler(next)
+			return spinnaker.HandlerFunc(next.Name(), func(ctx context.Context, incoming *types.IncomingWebhook) error {
+				record(label)
+				return h.HandleContext(ctx, incoming)
+			})
+		}
+	}
+
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		record("handler")
+		return nil
+	}))
+	d.UseFor("orca:stage:complete", named("hook"))
+	d.UseFor("orca:pipeline:complete", named("other hook"))
+	d.Use(named("first"), named("second"))
+
+	results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+	require.NoError(t, err)
+
+	result := <-results
+	require.NoError(t, result.Err)
+	assert.Equal(t, "handler", result.HandlerName)
+	assert.Equal(t, []string{"first", "second", "hook", "handler"}, calls)
+}
+
+func TestFilterMiddleware(t *testing.T) {
+	cases := []struct {
+		name        string
+		application string
+		called      bool
+	}{
+		{name: "accepted webhooks are handled", application: "hcm", called: true},
+		{name: "rejected webhooks are skipped", application: "other", called: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var called bool
+			d := spinnaker.NewDispatcher()
+			d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("handler", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+				called = true
+				return nil
+			}))
+			d.Use(spinnaker.Filter(func(incoming *types.IncomingWebhook) bool {
+				return incoming.Details.Application == c.application
+			}))
+
+			results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+			require.NoError(t, err)
+
+			result := <-results
+			require.NoError(t, result.Err)
+			assert.Equal(t, c.called, called)
+		})
+	}
+}
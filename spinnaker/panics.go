@@ -0,0 +1,130 @@
+package spinnaker
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// PanicError is the error of a DispatchResult when the handler panicked
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v\n%s", e.Value, e.Stack)
+}
+
+// WithPanicLimit disables a handler once it has panicked max times within the
+// given window. Handlers are disabled for the hook type they panicked for only,
+// and are skipped until EnableHandler is called
+func WithPanicLimit(max int, window time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.panics.max = max
+		d.panics.window = window
+	}
+}
+
+// EnableHandler enables the handler with the given name registered for the
+// given hook type again after it has been disabled for panicking too often
+func (d *Dispatcher) EnableHandler(hookType, name string) {
+	d.panics.mu.Lock()
+	defer d.panics.mu.Unlock()
+
+	key := handlerKey(hookType, name)
+	delete(d.panics.disabled, key)
+	delete(d.panics.seen, key)
+}
+
+// DisabledHandlers returns the handlers that have been disabled for panicking
+// too often, as "<hook type>/<name>"
+func (d *Dispatcher) DisabledHandlers() []string {
+	d.panics.mu.Lock()
+	defer d.panics.mu.Unlock()
+
+	names := make([]string, 0, len(d.panics.disabled))
+	for name := range d.panics.disabled {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// handlerKey identifies the handler with the given name registered for the
+// given hook type
+func handlerKey(hookType, name string) string {
+	return hookType + "/" + name
+}
+
+// panicTracker remembers when handlers panicked so the ones that keep
+// panicking can be disabled
+type panicTracker struct {
+	max    int
+	window time.Duration
+
+	mu       sync.Mutex
+	seen     map[string][]time.Time
+	disabled map[string]bool
+}
+
+func newPanicTracker() *panicTracker {
+	return &panicTracker{
+		seen:     make(map[string][]time.Time),
+		disabled: make(map[string]bool),
+	}
+}
+
+// record remembers a panic of the handler with the given key and disables it if
+// it went over the limit
+func (p *panicTracker) record(name string) {
+	if p.max <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	recent := p.seen[name][:0]
+	for _, at := range p.seen[name] {
+		if now.Sub(at) < p.window {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	p.seen[name] = recent
+
+	if len(recent) >= p.max && !p.disabled[name] {
+		p.disabled[name] = true
+		logrus.WithFields(logrus.Fields{
+			"handler": name,
+			"panics":  len(recent),
+			"window":  p.window.String(),
+		}).Error("disabling handler after repeated panics")
+	}
+}
+
+func (p *panicTracker) isDisabled(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.disabled[name]
+}
+
+// safeHandle runs the handler and turns a panic into a *PanicError
+func safeHandle(ctx context.Context, h ContextHandler, incoming *types.IncomingWebhook) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+
+	return h.HandleContext(ctx, incoming)
+}
@@ -0,0 +1,117 @@
+package spinnaker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// Phase orders the handlers of a webhook. Every handler of a phase finishes
+// before the handlers of the next phase start, while the handlers within a
+// phase run in parallel. Handlers that don't say otherwise run in PhaseEmit.
+type Phase int
+
+const (
+	// PhaseEnrich handlers look up extra information about the webhook
+	PhaseEnrich Phase = iota
+	// PhaseTransform handlers reshape the webhook or its annotations
+	PhaseTransform
+	// PhaseEmit handlers send the webhook somewhere
+	PhaseEmit
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseEnrich:
+		return "enrich"
+	case PhaseTransform:
+		return "transform"
+	case PhaseEmit:
+		return "emit"
+	}
+
+	return "unknown"
+}
+
+// PhasedHandler is a Handler that runs in a phase other than PhaseEmit
+type PhasedHandler interface {
+	Handler
+	Phase() Phase
+}
+
+// InPhase returns the given handler set to run in the given phase
+func InPhase(phase Phase, h Handler) Handler {
+	return phasedHandler{ContextHandler: AdaptHandler(h), handler: h, phase: phase}
+}
+
+type phasedHandler struct {
+	ContextHandler
+	handler Handler
+	phase   Phase
+}
+
+func (h phasedHandler) Handle(incoming *types.IncomingWebhook) error {
+	return h.handler.Handle(incoming)
+}
+
+func (h phasedHandler) Phase() Phase { return h.phase }
+
+// phaseOf returns the phase the given handler runs in
+func phaseOf(h Handler) Phase {
+	if ph, ok := h.(PhasedHandler); ok {
+		return ph.Phase()
+	}
+
+	return PhaseEmit
+}
+
+// Annotations are values handlers attach to a single dispatch so handlers of
+// later phases can read them. They are safe to use from concurrent handlers.
+type Annotations struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+// Set stores a value under the given key
+func (a *Annotations) Set(key string, value interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.values == nil {
+		a.values = make(map[string]interface{})
+	}
+	a.values[key] = value
+}
+
+// Get returns the value stored under the given key
+func (a *Annotations) Get(key string) (interface{}, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	value, ok := a.values[key]
+	return value, ok
+}
+
+// String returns the value stored under the given key if it is a string
+func (a *Annotations) String(key string) string {
+	value, _ := a.Get(key)
+	s, _ := value.(string)
+	return s
+}
+
+type annotationsKey struct{}
+
+// AnnotationsFrom returns the annotations of the dispatch the given context
+// belongs to. Outside of a dispatch a new, empty set of annotations is returned
+func AnnotationsFrom(ctx context.Context) *Annotations {
+	if a, ok := ctx.Value(annotationsKey{}).(*Annotations); ok {
+		return a
+	}
+
+	return new(Annotations)
+}
+
+func withAnnotations(ctx context.Context) context.Context {
+	return context.WithValue(ctx, annotationsKey{}, new(Annotations))
+}
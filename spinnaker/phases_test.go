@@ -0,0 +1,73 @@
+package spinnaker_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+func TestDispatcherRunsHandlersByPhase(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+	}
+
+	var seen string
+	d := spinnaker.NewDispatcher()
+	d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("emit", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		record("emit")
+		seen = spinnaker.AnnotationsFrom(ctx).String("team")
+		return nil
+	}))
+	d.AddHandler("orca:stage:complete", spinnaker.InPhase(spinnaker.PhaseTransform, spinnaker.HandlerFunc("transform", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		record("transform")
+		annotations := spinnaker.AnnotationsFrom(ctx)
+		annotations.Set("team", annotations.String("team")+"-transformed")
+		return nil
+	})))
+	d.AddHandler("orca:stage:complete", spinnaker.InPhase(spinnaker.PhaseEnrich, spinnaker.HandlerFunc("enrich", func(ctx context.Context, incoming *types.IncomingWebhook) error {
+		record("enrich")
+		spinnaker.AnnotationsFrom(ctx).Set("team", "bridge")
+		return nil
+	})))
+
+	results, err := d.HandleIncomingRequest(requestFromFile("valid-webhook.json"))
+	require.NoError(t, err)
+
+	var handled []string
+	for result := range results {
+		require.NoError(t, result.Err)
+		handled = append(handled, result.HandlerName)
+	}
+
+	assert.Equal(t, []string{"enrich", "transform", "emit"}, order)
+	assert.Equal(t, []string{"enrich", "transform", "emit"}, handled)
+	assert.Equal(t, "bridge-transformed", seen)
+}
+
+func TestDispatcherWebhookTimeoutAddsUpPhases(t *testing.T) {
+	d := spinnaker.NewDispatcher(
+		spinnaker.WithHandlerTimeout(time.Second),
+		spinnaker.WithHandlerTimeoutFor("lookup", 15*time.Second),
+	)
+	assert.Equal(t, time.Duration(0), d.WebhookTimeout())
+
+	noop := func(ctx context.Context, incoming *types.IncomingWebhook) error { return nil }
+	d.AddHandler("orca:stage:complete", spinnaker.InPhase(spinnaker.PhaseEnrich, spinnaker.HandlerFunc("lookup", noop)))
+	d.AddHandler("orca:stage:complete", spinnaker.InPhase(spinnaker.PhaseEnrich, spinnaker.HandlerFunc("enrich", noop)))
+	d.AddHandler("orca:stage:complete", spinnaker.HandlerFunc("emit", noop))
+	d.AddHandler("orca:task:complete", spinnaker.HandlerFunc("emit", noop))
+	d.AddHandler(spinnaker.AnyHookType, spinnaker.HandlerFunc("forward", noop))
+
+	assert.Equal(t, 16*time.Second, d.WebhookTimeout())
+}
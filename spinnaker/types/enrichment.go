@@ -0,0 +1,47 @@
+package types
+
+// Enrichment contains metadata about the application and pipeline of a webhook
+// that is not sent by Echo, but is available from Spinnaker's Gate API
+type Enrichment struct {
+	Application Application `json:"application"`
+	Pipeline    Pipeline    `json:"pipeline"`
+
+	// Attempted is set once the webhook has been looked up in Gate, even when
+	// the lookup failed, so handlers don't look it up a second time
+	Attempted bool `json:"-"`
+}
+
+// Application is the configuration of a Spinnaker application as returned by
+// Gate at /applications/{app}
+type Application struct {
+	Name           string `json:"name"`
+	Email          string `json:"email"`
+	Description    string `json:"description"`
+	RepoType       string `json:"repoType"`
+	RepoProjectKey string `json:"repoProjectKey"`
+	RepoSlug       string `json:"repoSlug"`
+
+	// Attributes holds every attribute of the application, including custom
+	// ones such as "team" that don't have a dedicated field
+	Attributes map[string]interface{} `json:"-"`
+}
+
+// Pipeline is a Spinnaker pipeline configuration as returned by Gate at
+// /applications/{app}/pipelineConfigs
+type Pipeline struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Application string `json:"application"`
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled"`
+}
+
+// Attribute returns the custom application attribute with the given key as a
+// string, or an empty string when it isn't set
+func (a Application) Attribute(key string) string {
+	if v, ok := a.Attributes[key].(string); ok {
+		return v
+	}
+
+	return ""
+}
@@ -1,11 +1,32 @@
 package types
 
+import "encoding/json"
+
 // IncomingWebhook is a structure representing a Spinnaker echo rest Webhook
 // You can view an example of the schema here:
 // https://www.spinnaker.io/setup/features/notifications/#event-types
 type IncomingWebhook struct {
 	Details Details `json:"details"`
 	Content Content `json:"content"`
+
+	// Enrichment is not part of the webhook payload. It is filled in from
+	// Spinnaker's application and pipeline configuration when an enricher is
+	// configured so templates can reference it
+	Enrichment Enrichment `json:"-"`
+
+	// Raw is the webhook payload as it was received, when the webhook was
+	// decoded by the dispatcher. It is not modified by handlers
+	Raw json.RawMessage `json:"-"`
+}
+
+// Application returns the application of the webhook, which Echo leaves out of
+// the details of some webhooks
+func (w *IncomingWebhook) Application() string {
+	if w.Details.Application != "" {
+		return w.Details.Application
+	}
+
+	return w.Content.Execution.Application
 }
 
 // Details contains all of the details contained in the webhook
@@ -19,10 +40,70 @@ type Details struct {
 // Content is the main context of the given Webhook. It contains of the execution
 // information and stage details as an example
 type Content struct {
-	ExecutionID string    `json:"executionId"`
-	StartTime   Timestamp `json:"startTime"`
-	EndTime     Timestamp `json:"endTime"`
-	Execution   Execution `json:"execution,omitempty"`
+	ExecutionID string                 `json:"executionId"`
+	StartTime   Timestamp              `json:"startTime"`
+	EndTime     Timestamp              `json:"endTime"`
+	Execution   Execution              `json:"execution,omitempty"`
+	Context     map[string]interface{} `json:"context,omitempty"`
+	TaskName    string                 `json:"taskName,omitempty"`
+}
+
+// StageDetails describes the stage of stage and task webhooks
+type StageDetails struct {
+	// ID identifies the stage within its execution. Stages can share a name,
+	// so it is looked up from the stages of the execution when Echo doesn't
+	// send it, and is empty when the stage can't be told apart from others
+	ID        string    `json:"id,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	StartTime Timestamp `json:"startTime"`
+	EndTime   Timestamp `json:"endTime"`
+}
+
+// StageDetails returns the details of the stage from the stage context, which
+// are empty for pipeline webhooks
+func (c Content) StageDetails() StageDetails {
+	var details StageDetails
+
+	raw, ok := c.Context["stageDetails"]
+	if !ok {
+		return details
+	}
+
+	// The context is decoded as a generic map, so the details are encoded
+	// again to decode them into their typed fields
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return details
+	}
+	if err := json.Unmarshal(b, &details); err != nil {
+		return StageDetails{}
+	}
+	if details.ID == "" {
+		details.ID = c.Execution.stageID(details)
+	}
+
+	return details
+}
+
+// Key returns the ID of the stage, or its name when the ID isn't known
+func (s StageDetails) Key() string {
+	if s.ID != "" {
+		return s.ID
+	}
+
+	return s.Name
+}
+
+// ContextString returns the value of the given key from the stage context as a
+// string, or an empty string when it isn't set. This is useful in templates
+// for values such as "account" or "region" that only some stages have
+func (c Content) ContextString(key string) string {
+	if v, ok := c.Context[key].(string); ok {
+		return v
+	}
+
+	return ""
 }
 
 // Execution represents an execution context for a spinnaker event
@@ -42,10 +123,90 @@ type Execution struct {
 	Stages           []interface{}  `json:"stages,omitempty"`
 }
 
+// stageID returns the ID of the stage of the execution with the name of the
+// given stage. Stages that share a name are told apart by their start time
+func (e Execution) stageID(details StageDetails) string {
+	var ids []string
+	for _, raw := range e.Stages {
+		stage, ok := raw.(map[string]interface{})
+		if !ok || stage["name"] != details.Name {
+			continue
+		}
+		id, ok := stage["id"].(string)
+		if !ok {
+			continue
+		}
+		ids = append(ids, id)
+
+		if started, ok := stage["startTime"].(float64); ok && !details.StartTime.IsZero() &&
+			int64(started)/1000 == details.StartTime.Unix() {
+			return id
+		}
+	}
+
+	if len(ids) == 1 {
+		return ids[0]
+	}
+
+	return ""
+}
+
 // Trigger represents a pipeline trigger
 type Trigger struct {
-	User string `json:"user,omitempty"`
-	Type string `json:"type,omitempty"`
+	User       string     `json:"user,omitempty"`
+	Type       string     `json:"type,omitempty"`
+	Account    string     `json:"account,omitempty"`
+	Repository string     `json:"repository,omitempty"`
+	Tag        string     `json:"tag,omitempty"`
+	Artifacts  []Artifact `json:"artifacts,omitempty"`
+
+	// Git triggers carry the commit that triggered the pipeline. Source is
+	// the git provider (github, gitlab, bitbucket or stash) and Project and
+	// Slug identify the repository
+	Source  string `json:"source,omitempty"`
+	Project string `json:"project,omitempty"`
+	Slug    string `json:"slug,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+}
+
+// gitHosts are the hosts of the git providers whose repository URL can be
+// derived from a git trigger
+var gitHosts = map[string]string{
+	"github":    "github.com",
+	"gitlab":    "gitlab.com",
+	"bitbucket": "bitbucket.org",
+}
+
+// RepositoryURL returns the URL of the repository of a git trigger, or an
+// empty string when it can't be derived
+func (t Trigger) RepositoryURL() string {
+	host, ok := gitHosts[t.Source]
+	if !ok || t.Project == "" || t.Slug == "" {
+		return ""
+	}
+
+	return "https://" + host + "/" + t.Project + "/" + t.Slug
+}
+
+// ArtifactVersion returns the version of the first artifact of the trigger
+// that has one, or an empty string when there is none
+func (t Trigger) ArtifactVersion() string {
+	for _, artifact := range t.Artifacts {
+		if artifact.Version != "" {
+			return artifact.Version
+		}
+	}
+
+	return ""
+}
+
+// Artifact is an artifact that was supplied to a pipeline by its trigger
+type Artifact struct {
+	Type      string `json:"type,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Reference string `json:"reference,omitempty"`
 }
 
 // Authentication holds potential authentication information
@@ -0,0 +1,108 @@
+package spinnakerdatadog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+// apiClient posts to one of the Datadog HTTP APIs with an API key and records
+// the result of every call
+type apiClient struct {
+	name     string
+	baseURL  string
+	apiKey   string
+	client   *http.Client
+	recorder telemetry.Recorder
+}
+
+// newAPIClient initializes a client for the API with the given name, used in
+// errors, located at baseURL (defaultURL when empty)
+func newAPIClient(name, baseURL, defaultURL, apiKey string) apiClient {
+	if baseURL == "" {
+		baseURL = defaultURL
+	}
+
+	return apiClient{
+		name:     name,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		apiKey:   apiKey,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		recorder: telemetry.Nop{},
+	}
+}
+
+// postJSON encodes v and posts it to the given path. The call is recorded as
+// endpoint
+func (c *apiClient) postJSON(ctx context.Context, path, endpoint string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "could not encode %s request", c.name)
+	}
+
+	return c.post(ctx, path, endpoint, body, nil)
+}
+
+// post sends the given JSON body to the given path with the extra headers. The
+// call is recorded as endpoint
+func (c *apiClient) post(ctx context.Context, path, endpoint string, body []byte, header http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "could not create request")
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", c.apiKey)
+
+	start := time.Now()
+	err = c.do(req)
+	c.recorder.DatadogAPICall(endpoint, time.Since(start), err)
+
+	return err
+}
+
+func (c *apiClient) do(req *http.Request) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "could not reach %s", c.name)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{api: c.name, code: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// statusError is returned when an API answers with an unexpected status code
+type statusError struct {
+	api  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code from %s: %d", e.api, e.code)
+}
+
+// retryable returns whether the call that failed with err may succeed when
+// retried later: the API couldn't be reached, was rate limited or failed
+// unexpectedly. Other errors won't go away on their own
+func retryable(err error) bool {
+	if err, ok := errors.Cause(err).(*statusError); ok {
+		return err.code == http.StatusTooManyRequests || err.code == http.StatusRequestTimeout || err.code >= 500
+	}
+
+	return err != nil
+}
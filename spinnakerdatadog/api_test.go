@@ -0,0 +1,61 @@
+package spinnakerdatadog_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// apiRequest is a request received by a fake Datadog API. Body is decompressed
+// when the request is gzipped, and Err is set when it couldn't be read
+type apiRequest struct {
+	Path string
+	Body []byte
+	Err  error
+}
+
+// decode decodes the JSON body of the request into v
+func (r apiRequest) decode(t *testing.T, v interface{}) {
+	require.NoError(t, r.Err)
+	require.NoError(t, json.Unmarshal(r.Body, v))
+}
+
+// newFakeAPI starts a stand-in for the Datadog APIs that checks the API key of
+// every request and sends it on the returned channel. It answers with the given
+// status codes in order, then with 202
+func newFakeAPI(t *testing.T, codes ...int) (*httptest.Server, <-chan apiRequest) {
+	requests := make(chan apiRequest, 10)
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "apikey", req.Header.Get("DD-API-KEY"))
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		r := apiRequest{Path: req.URL.Path}
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			body, r.Err = gzip.NewReader(req.Body)
+		}
+		if r.Err == nil {
+			r.Body, r.Err = ioutil.ReadAll(body)
+		}
+		requests <- r
+
+		mu.Lock()
+		code := http.StatusAccepted
+		if len(codes) > 0 {
+			code, codes = codes[0], codes[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(code)
+	}))
+
+	return ts, requests
+}
@@ -0,0 +1,333 @@
+package spinnakerdatadog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+// CIVisibilitySinkName is the name templates use to send to the CI Visibility sink
+const CIVisibilitySinkName = "ci-visibility"
+
+// CIVisibilitySink sends pipeline, stage and task webhooks to Datadog CI
+// Visibility as pipeline, stage and job events. Only webhooks of finished
+// executions are sent since CI Visibility needs their end time, and metrics
+// and service checks are ignored.
+type CIVisibilitySink struct {
+	api          apiClient
+	executionURL string
+}
+
+var _ sink.Sink = (*CIVisibilitySink)(nil)
+
+// CIVisibilityOption configures optional behavior of a CI Visibility sink
+type CIVisibilityOption func(*CIVisibilitySink)
+
+// WithExecutionURL links pipelines in CI Visibility to the execution in
+// Spinnaker's UI (Deck) located at the given URL (https://spinnaker.example.com
+// for example)
+func WithExecutionURL(deckURL string) CIVisibilityOption {
+	return func(s *CIVisibilitySink) {
+		s.executionURL = strings.TrimRight(deckURL, "/")
+	}
+}
+
+// WithCIVisibilityRecorder records the result of every call to the CI
+// Visibility API with the given recorder
+func WithCIVisibilityRecorder(r telemetry.Recorder) CIVisibilityOption {
+	return func(s *CIVisibilitySink) {
+		s.api.recorder = r
+	}
+}
+
+// WithCIVisibilityHTTPClient sends requests to the CI Visibility API with the
+// given client, such as one built by NewHTTPClient
+func WithCIVisibilityHTTPClient(c *http.Client) CIVisibilityOption {
+	return func(s *CIVisibilitySink) {
+		s.api.client = c
+	}
+}
+
+// NewCIVisibilitySink initializes a sink that sends to the Datadog API located
+// at baseURL (DefaultAPIURL when empty) with the given API key
+func NewCIVisibilitySink(baseURL, apiKey string, opts ...CIVisibilityOption) *CIVisibilitySink {
+	s := &CIVisibilitySink{api: newAPIClient("ci visibility api", baseURL, DefaultAPIURL, apiKey)}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Name implements sink.Sink
+func (s *CIVisibilitySink) Name() string {
+	return CIVisibilitySinkName
+}
+
+// SendMetric implements sink.Sink. CI Visibility has no metrics, so it does nothing
+func (s *CIVisibilitySink) SendMetric(context.Context, *sink.Metric) error {
+	return nil
+}
+
+// SendServiceCheck implements sink.Sink. CI Visibility has no service checks,
+// so it does nothing
+func (s *CIVisibilitySink) SendServiceCheck(context.Context, *sink.ServiceCheck) error {
+	return nil
+}
+
+// SendEvent implements sink.Sink. It sends the webhook the event was rendered
+// from as a pipeline, stage or job event depending on its type
+func (s *CIVisibilitySink) SendEvent(ctx context.Context, event *sink.Event) error {
+	if event.Webhook == nil {
+		return nil
+	}
+
+	return s.send(ctx, event.Webhook)
+}
+
+// send sends the given webhook as a pipeline, stage or job event
+func (s *CIVisibilitySink) send(ctx context.Context, incoming *types.IncomingWebhook) error {
+	resource := s.resource(incoming)
+	if resource == nil {
+		return nil
+	}
+
+	return s.api.postJSON(ctx, "/api/v2/ci/pipeline", "ci_pipeline", map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "cipipeline_resource_request",
+			"attributes": map[string]interface{}{
+				"provider_name": "spinnaker",
+				"resource":      resource,
+			},
+		},
+	})
+}
+
+// ciVisibilityHookTypes are the hook types of the webhooks CI Visibility is
+// sent, those of finished pipelines, stages and tasks
+var ciVisibilityHookTypes = []string{
+	"orca:pipeline:complete", "orca:pipeline:failed",
+	"orca:stage:complete", "orca:stage:failed",
+	"orca:task:complete", "orca:task:failed",
+}
+
+// ciVisibilityHandler sends the webhooks of ciVisibilityHookTypes to a CI
+// Visibility sink
+type ciVisibilityHandler struct {
+	sink *CIVisibilitySink
+}
+
+var (
+	_ spinnaker.Handler        = (*ciVisibilityHandler)(nil)
+	_ spinnaker.ContextHandler = (*ciVisibilityHandler)(nil)
+)
+
+// Name implements spinnaker.Handler
+func (h *ciVisibilityHandler) Name() string {
+	return "CIVisibilityHandler"
+}
+
+// Handle implements spinnaker.Handler
+func (h *ciVisibilityHandler) Handle(incoming *types.IncomingWebhook) error {
+	return h.HandleContext(context.Background(), incoming)
+}
+
+// HandleContext implements spinnaker.ContextHandler
+func (h *ciVisibilityHandler) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	return errors.Wrap(h.sink.send(ctx, incoming), "could not send webhook to ci visibility")
+}
+
+// resource maps the webhook onto a CI Visibility pipeline, stage or job. It
+// returns nil for webhooks that aren't sent
+func (s *CIVisibilitySink) resource(incoming *types.IncomingWebhook) map[string]interface{} {
+	parts := strings.Split(incoming.Details.Type, ":")
+	if len(parts) < 3 || (parts[2] != "complete" && parts[2] != "failed") {
+		return nil
+	}
+	kind := parts[1]
+
+	execution := incoming.Content.Execution
+	executionID := incoming.Content.ExecutionID
+	if executionID == "" {
+		executionID = execution.ID
+	}
+
+	stage := incoming.Content.StageDetails()
+	status := ciStatus(parts[2], ownStatus(kind, incoming, stage))
+	stageID := ciID(executionID, stage.Key())
+
+	var resource map[string]interface{}
+	switch kind {
+	case "pipeline":
+		resource = map[string]interface{}{
+			"level":         "pipeline",
+			"unique_id":     executionID,
+			"name":          execution.Name,
+			"url":           s.url(incoming, executionID),
+			"start":         ciTime(execution.StartTime.Time, incoming),
+			"end":           ciTime(execution.EndTime.Time, incoming),
+			"status":        status,
+			"partial_retry": false,
+		}
+		if git := ciGit(execution.Trigger); git != nil {
+			resource["git"] = git
+		}
+	case "stage":
+		resource = map[string]interface{}{
+			"level":              "stage",
+			"id":                 stageID,
+			"name":               stage.Name,
+			"pipeline_unique_id": executionID,
+			"pipeline_name":      execution.Name,
+			"start":              ciTime(stage.StartTime.Time, incoming),
+			"end":                ciTime(stage.EndTime.Time, incoming),
+			"status":             status,
+		}
+	case "task":
+		resource = map[string]interface{}{
+			"level":              "job",
+			"id":                 ciID(executionID, stage.Key(), incoming.Content.TaskName),
+			"name":               incoming.Content.TaskName,
+			"pipeline_unique_id": executionID,
+			"pipeline_name":      execution.Name,
+			"stage_id":           stageID,
+			"stage_name":         stage.Name,
+			"url":                s.url(incoming, executionID),
+			"start":              ciTime(incoming.Content.StartTime.Time, incoming),
+			"end":                ciTime(incoming.Content.EndTime.Time, incoming),
+			"status":             status,
+		}
+	default:
+		return nil
+	}
+
+	resource["tags"] = []string{"app:" + incoming.Details.Application}
+
+	return resource
+}
+
+// url links to the execution in Deck, or identifies it when no Deck URL is set
+func (s *CIVisibilitySink) url(incoming *types.IncomingWebhook, executionID string) string {
+	if s.executionURL == "" {
+		return fmt.Sprintf("spinnaker://%s/executions/%s", url.PathEscape(incoming.Details.Application), url.PathEscape(executionID))
+	}
+
+	return fmt.Sprintf("%s/#/applications/%s/executions/details/%s", s.executionURL, url.PathEscape(incoming.Details.Application), url.PathEscape(executionID))
+}
+
+// ciStatus maps the status of a webhook, along with the status Spinnaker gives
+// the pipeline, stage or task it is about, onto a CI Visibility status
+func ciStatus(status, spinnakerStatus string) string {
+	switch {
+	case spinnakerStatus == "CANCELED":
+		return "canceled"
+	case spinnakerStatus == "SKIPPED":
+		return "skipped"
+	case status == "failed":
+		return "error"
+	}
+
+	return "success"
+}
+
+// ownStatus returns the status Spinnaker gives the pipeline, stage or task the
+// webhook is about, which is empty when the execution doesn't include it. Only
+// pipelines are marked as cancelled as a whole: the stages of a cancelled
+// execution that finished before it was cancelled keep their status
+func ownStatus(kind string, incoming *types.IncomingWebhook, details types.StageDetails) string {
+	execution := incoming.Content.Execution
+	if kind == "pipeline" {
+		if execution.Canceled {
+			return "CANCELED"
+		}
+		return execution.Status
+	}
+
+	stage := executionStage(execution, details)
+	if kind == "stage" {
+		status, _ := stage["status"].(string)
+		return status
+	}
+
+	tasks, _ := stage["tasks"].([]interface{})
+	for _, raw := range tasks {
+		if task, ok := raw.(map[string]interface{}); ok && task["name"] == incoming.Content.TaskName {
+			status, _ := task["status"].(string)
+			return status
+		}
+	}
+
+	return ""
+}
+
+// executionStage returns the stage of the execution with the given details,
+// identified by its ID or by its name when the ID isn't known. It returns nil
+// when the execution doesn't include the stage
+func executionStage(execution types.Execution, details types.StageDetails) map[string]interface{} {
+	for _, raw := range execution.Stages {
+		stage, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if details.ID != "" && stage["id"] == details.ID {
+			return stage
+		}
+		if details.ID == "" && stage["name"] == details.Name {
+			return stage
+		}
+	}
+
+	return nil
+}
+
+// ciID derives a stable ID for a stage or job from the execution ID, the stage
+// ID and the task name
+func ciID(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\xff")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ciTime formats the given time, falling back to when the webhook was created
+func ciTime(t time.Time, incoming *types.IncomingWebhook) string {
+	if t.IsZero() {
+		if ms, err := strconv.ParseInt(incoming.Details.Created, 10, 64); err == nil {
+			t = time.Unix(0, ms*int64(time.Millisecond))
+		} else {
+			t = time.Now()
+		}
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ciGit returns the git information of a git trigger, or nil for other triggers
+func ciGit(trigger types.Trigger) map[string]interface{} {
+	repositoryURL := trigger.RepositoryURL()
+	if repositoryURL == "" || trigger.Hash == "" {
+		return nil
+	}
+
+	git := map[string]interface{}{
+		"repository_url": repositoryURL,
+		"sha":            trigger.Hash,
+		"author_email":   trigger.User,
+	}
+	if trigger.Branch != "" {
+		git["branch"] = trigger.Branch
+	}
+
+	return git
+}
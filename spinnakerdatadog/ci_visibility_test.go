@@ -0,0 +1,215 @@
+package spinnakerdatadog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+type ciRequest struct {
+	Data struct {
+		Type       string `json:"type"`
+		Attributes struct {
+			ProviderName string                 `json:"provider_name"`
+			Resource     map[string]interface{} `json:"resource"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// ciResource decodes the resource of a request to the CI Visibility API
+func ciResource(t *testing.T, r apiRequest) map[string]interface{} {
+	assert.Equal(t, "/api/v2/ci/pipeline", r.Path)
+
+	var body ciRequest
+	r.decode(t, &body)
+	assert.Equal(t, "cipipeline_resource_request", body.Data.Type)
+	assert.Equal(t, "spinnaker", body.Data.Attributes.ProviderName)
+
+	return body.Data.Attributes.Resource
+}
+
+func TestCIVisibilitySinkSendsPipelines(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewCIVisibilitySink(ts.URL, "apikey", spinnakerdatadog.WithExecutionURL("https://spinnaker.example.com/"))
+	err := s.SendEvent(context.Background(), &sink.Event{Webhook: &types.IncomingWebhook{
+		Details: types.Details{Application: "hcm", Type: "orca:pipeline:failed"},
+		Content: types.Content{
+			ExecutionID: "01C5ZJ",
+			Execution: types.Execution{
+				Name:      "Deploy to prod",
+				StartTime: types.Timestamp{Time: time.Unix(1518214000, 0)},
+				EndTime:   types.Timestamp{Time: time.Unix(1518214010, 0)},
+				Trigger: types.Trigger{
+					Type:    "git",
+					User:    "someone@example.com",
+					Source:  "github",
+					Project: "DataDog",
+					Slug:    "spinnaker-datadog-bridge",
+					Branch:  "master",
+					Hash:    "0123abcd",
+				},
+			},
+		},
+	}})
+	require.NoError(t, err)
+
+	resource := ciResource(t, <-requests)
+	assert.Equal(t, "pipeline", resource["level"])
+	assert.Equal(t, "01C5ZJ", resource["unique_id"])
+	assert.Equal(t, "Deploy to prod", resource["name"])
+	assert.Equal(t, "error", resource["status"])
+	assert.Equal(t, "2018-02-09T22:06:40Z", resource["start"])
+	assert.Equal(t, "2018-02-09T22:06:50Z", resource["end"])
+	assert.Equal(t, "https://spinnaker.example.com/#/applications/hcm/executions/details/01C5ZJ", resource["url"])
+	assert.Equal(t, map[string]interface{}{
+		"repository_url": "https://github.com/DataDog/spinnaker-datadog-bridge",
+		"sha":            "0123abcd",
+		"author_email":   "someone@example.com",
+		"branch":         "master",
+	}, resource["git"])
+}
+
+func TestCIVisibilitySinkSendsStagesAndJobs(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewCIVisibilitySink(ts.URL, "apikey")
+	webhook := func(hookType string) *sink.Event {
+		return &sink.Event{Webhook: &types.IncomingWebhook{
+			Details: types.Details{Application: "hcm", Type: hookType, Created: "1518214003433"},
+			Content: types.Content{
+				ExecutionID: "01C5ZJ",
+				TaskName:    "deploy.createServerGroup",
+				Context: map[string]interface{}{
+					"stageDetails": map[string]interface{}{"name": "Deploy", "startTime": 1518214001000, "endTime": 1518214009000},
+				},
+				Execution: types.Execution{Name: "Deploy to prod"},
+			},
+		}}
+	}
+
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:stage:starting")))
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:stage:complete")))
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:task:complete")))
+
+	stage := ciResource(t, <-requests)
+	assert.Equal(t, "stage", stage["level"])
+	assert.Equal(t, "Deploy", stage["name"])
+	assert.Equal(t, "01C5ZJ", stage["pipeline_unique_id"])
+	assert.Equal(t, "success", stage["status"])
+	assert.Equal(t, "2018-02-09T22:06:41Z", stage["start"])
+
+	job := ciResource(t, <-requests)
+	assert.Equal(t, "job", job["level"])
+	assert.Equal(t, "deploy.createServerGroup", job["name"])
+	assert.Equal(t, stage["id"], job["stage_id"])
+	assert.Equal(t, "spinnaker://hcm/executions/01C5ZJ", job["url"])
+	assert.Equal(t, "2018-02-09T22:06:43.433Z", job["end"])
+
+	assert.Empty(t, requests, "starting webhooks should not be sent")
+}
+
+func TestCIVisibilitySinkSeparatesStagesWithTheSameName(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewCIVisibilitySink(ts.URL, "apikey")
+	webhook := func(start int64) *sink.Event {
+		return &sink.Event{Webhook: &types.IncomingWebhook{
+			Details: types.Details{Application: "hcm", Type: "orca:stage:complete"},
+			Content: types.Content{
+				ExecutionID: "01C5ZJ",
+				Context: map[string]interface{}{
+					"stageDetails": map[string]interface{}{"name": "Wait", "startTime": start},
+				},
+				Execution: types.Execution{Stages: []interface{}{
+					map[string]interface{}{"id": "01STAGE1", "name": "Wait", "startTime": float64(1518214001000)},
+					map[string]interface{}{"id": "01STAGE2", "name": "Wait", "startTime": float64(1518214005000)},
+				}},
+			},
+		}}
+	}
+
+	require.NoError(t, s.SendEvent(context.Background(), webhook(1518214001000)))
+	require.NoError(t, s.SendEvent(context.Background(), webhook(1518214005000)))
+
+	first, second := ciResource(t, <-requests), ciResource(t, <-requests)
+	assert.Equal(t, "Wait", first["name"])
+	assert.Equal(t, "Wait", second["name"])
+	assert.NotEqual(t, first["id"], second["id"])
+}
+
+func TestCIVisibilitySinkReportsTheStatusOfEachStage(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewCIVisibilitySink(ts.URL, "apikey")
+	execution := types.Execution{
+		Canceled: true,
+		Status:   "CANCELED",
+		Stages: []interface{}{
+			map[string]interface{}{"id": "01STAGE1", "name": "Bake", "status": "SUCCEEDED", "tasks": []interface{}{
+				map[string]interface{}{"name": "bake", "status": "SUCCEEDED"},
+			}},
+			map[string]interface{}{"id": "01STAGE2", "name": "Deploy", "status": "CANCELED", "tasks": []interface{}{
+				map[string]interface{}{"name": "deploy", "status": "CANCELED"},
+			}},
+		},
+	}
+	webhook := func(hookType, stage, task string) *sink.Event {
+		return &sink.Event{Webhook: &types.IncomingWebhook{
+			Details: types.Details{Application: "hcm", Type: hookType},
+			Content: types.Content{
+				ExecutionID: "01C5ZJ",
+				TaskName:    task,
+				Context: map[string]interface{}{
+					"stageDetails": map[string]interface{}{"name": stage},
+				},
+				Execution: execution,
+			},
+		}}
+	}
+
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:stage:complete", "Bake", "")))
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:task:complete", "Bake", "bake")))
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:stage:failed", "Deploy", "")))
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:task:failed", "Deploy", "deploy")))
+	require.NoError(t, s.SendEvent(context.Background(), webhook("orca:pipeline:failed", "", "")))
+
+	for _, status := range []string{"success", "success", "canceled", "canceled", "canceled"} {
+		assert.Equal(t, status, ciResource(t, <-requests)["status"])
+	}
+}
+
+func TestSpoutSendsFinishedWebhooksToCIVisibility(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	spout, err := spinnakerdatadog.NewSpout(nil, "", spinnakerdatadog.WithCIVisibility(spinnakerdatadog.NewCIVisibilitySink(ts.URL, "apikey")))
+	require.NoError(t, err)
+
+	d := spinnaker.NewDispatcher()
+	spout.AttachToDispatcher(d)
+
+	stageStarting := *pipelineComplete
+	stageStarting.Details.Type = "orca:stage:starting"
+	for _, incoming := range []*types.IncomingWebhook{pipelineComplete, &stageStarting} {
+		for result := range d.Dispatch(context.Background(), incoming) {
+			require.NoError(t, result.Err)
+			assert.Equal(t, "CIVisibilityHandler", result.HandlerName)
+		}
+	}
+
+	assert.Equal(t, "pipeline", ciResource(t, <-requests)["level"])
+	assert.Empty(t, requests, "starting webhooks should not be sent")
+}
@@ -0,0 +1,238 @@
+package spinnakerdatadog
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultKeyRefresh is how often key files are checked for rotated keys
+const DefaultKeyRefresh = 30 * time.Second
+
+// Credentials holds the API and application keys requests to Datadog are
+// authenticated with. Keys can be read from files, such as Kubernetes secret
+// mounts, which are re-read periodically so rotated keys take effect without
+// a restart. Keys are never logged.
+//
+// Clients pick up the current keys by sending through Transport, which
+// replaces the keys they put on requests. Clients should therefore be built
+// with empty keys, which also keeps keys out of the errors they return.
+type Credentials struct {
+	apiKeyFile string
+	appKeyFile string
+	refresh    time.Duration
+
+	mu     sync.RWMutex
+	apiKey string
+	appKey string
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// CredentialsOption configures optional behavior of credentials
+type CredentialsOption func(*Credentials)
+
+// WithAPIKeyFile reads the API key from the given file instead
+func WithAPIKeyFile(file string) CredentialsOption {
+	return func(c *Credentials) {
+		c.apiKeyFile = file
+	}
+}
+
+// WithAppKeyFile reads the application key from the given file instead
+func WithAppKeyFile(file string) CredentialsOption {
+	return func(c *Credentials) {
+		c.appKeyFile = file
+	}
+}
+
+// WithKeyRefresh re-reads the key files at the given interval
+// (DefaultKeyRefresh by default). Zero turns re-reading off
+func WithKeyRefresh(interval time.Duration) CredentialsOption {
+	return func(c *Credentials) {
+		c.refresh = interval
+	}
+}
+
+// NewCredentials initializes credentials with the given keys, or with the
+// keys read from the files given as options. When keys are read from files,
+// the credentials must be closed to stop re-reading them
+func NewCredentials(apiKey, appKey string, opts ...CredentialsOption) (*Credentials, error) {
+	c := &Credentials{
+		apiKey:  apiKey,
+		appKey:  appKey,
+		refresh: DefaultKeyRefresh,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	if (c.apiKeyFile == "" && c.appKeyFile == "") || c.refresh <= 0 {
+		close(c.stopped)
+		return c, nil
+	}
+
+	go c.refreshLoop()
+
+	return c, nil
+}
+
+// Keys returns the current API and application keys
+func (c *Credentials) Keys() (apiKey, appKey string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.apiKey, c.appKey
+}
+
+// Reload re-reads the key files. The current keys are kept when a file can't
+// be read or is empty
+func (c *Credentials) Reload() error {
+	apiKey, appKey := c.Keys()
+
+	if c.apiKeyFile != "" {
+		key, err := readKeyFile(c.apiKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read datadog api key")
+		}
+		if key != apiKey && apiKey != "" {
+			logrus.WithField("file", c.apiKeyFile).Info("datadog api key changed")
+		}
+		apiKey = key
+	}
+
+	if c.appKeyFile != "" {
+		key, err := readKeyFile(c.appKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read datadog app key")
+		}
+		if key != appKey && appKey != "" {
+			logrus.WithField("file", c.appKeyFile).Info("datadog app key changed")
+		}
+		appKey = key
+	}
+
+	c.mu.Lock()
+	c.apiKey, c.appKey = apiKey, appKey
+	c.mu.Unlock()
+
+	return nil
+}
+
+func readKeyFile(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", errors.Errorf("%s is empty", file)
+	}
+
+	return key, nil
+}
+
+func (c *Credentials) refreshLoop() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Reload(); err != nil {
+				logrus.WithError(err).Error("could not reload datadog keys")
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops re-reading the key files
+func (c *Credentials) Close() error {
+	select {
+	case <-c.stopped:
+	default:
+		close(c.stop)
+		<-c.stopped
+	}
+
+	return nil
+}
+
+// Client returns a copy of the given client that sends through Transport
+func (c *Credentials) Client(base *http.Client) *http.Client {
+	client := *base
+	client.Transport = c.Transport(base.Transport)
+
+	return &client
+}
+
+// Transport returns a round tripper that replaces the keys of every request
+// with the current keys before sending it with next (http.DefaultTransport
+// when nil). Keys are replaced in the DD-API-KEY and DD-APPLICATION-KEY
+// headers and in the api_key and application_key query parameters, only when
+// the request has them
+func (c *Credentials) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &credentialsTransport{credentials: c, next: next}
+}
+
+type credentialsTransport struct {
+	credentials *Credentials
+	next        http.RoundTripper
+}
+
+func (t *credentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	apiKey, appKey := t.credentials.Keys()
+
+	// Round trippers must not modify the request they're given
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	u := *req.URL
+	r.URL = &u
+
+	if _, ok := r.Header["Dd-Api-Key"]; ok {
+		r.Header.Set("DD-API-KEY", apiKey)
+	}
+	if _, ok := r.Header["Dd-Application-Key"]; ok {
+		r.Header.Set("DD-APPLICATION-KEY", appKey)
+	}
+
+	q := r.URL.Query()
+	_, hasAPIKey := q["api_key"]
+	_, hasAppKey := q["application_key"]
+	if hasAPIKey {
+		q.Set("api_key", apiKey)
+	}
+	if hasAppKey {
+		q.Set("application_key", appKey)
+	}
+	if hasAPIKey || hasAppKey {
+		r.URL.RawQuery = q.Encode()
+	}
+
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,102 @@
+package spinnakerdatadog_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+func writeKey(t *testing.T, file, key string) {
+	require.NoError(t, ioutil.WriteFile(file, []byte(key+"\n"), 0600))
+}
+
+func TestCredentialsReadKeyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	apiKeyFile, appKeyFile := filepath.Join(dir, "api-key"), filepath.Join(dir, "app-key")
+	writeKey(t, apiKeyFile, "api-1")
+	writeKey(t, appKeyFile, "app-1")
+
+	credentials, err := spinnakerdatadog.NewCredentials("", "",
+		spinnakerdatadog.WithAPIKeyFile(apiKeyFile),
+		spinnakerdatadog.WithAppKeyFile(appKeyFile),
+		spinnakerdatadog.WithKeyRefresh(10*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer credentials.Close()
+
+	apiKey, appKey := credentials.Keys()
+	assert.Equal(t, "api-1", apiKey)
+	assert.Equal(t, "app-1", appKey)
+
+	writeKey(t, apiKeyFile, "api-2")
+	deadline := time.Now().Add(time.Second)
+	for apiKey != "api-2" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		apiKey, _ = credentials.Keys()
+	}
+	assert.Equal(t, "api-2", apiKey, "rotated key was never read")
+
+	// An empty file is a secret being rotated, not a new key
+	writeKey(t, apiKeyFile, "")
+	assert.Error(t, credentials.Reload())
+	apiKey, _ = credentials.Keys()
+	assert.Equal(t, "api-2", apiKey)
+
+	require.NoError(t, credentials.Close())
+}
+
+func TestCredentialsRequireReadableFiles(t *testing.T) {
+	_, err := spinnakerdatadog.NewCredentials("", "", spinnakerdatadog.WithAPIKeyFile("testdata/missing-key"))
+	assert.Error(t, err)
+}
+
+func TestCredentialsTransportReplacesKeys(t *testing.T) {
+	type received struct {
+		apiKeyHeader             string
+		hasAppKeyHeader          bool
+		apiKeyQuery, appKeyQuery string
+	}
+	requests := make(chan received, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, hasAppKey := req.Header["Dd-Application-Key"]
+		requests <- received{
+			apiKeyHeader:    req.Header.Get("DD-API-KEY"),
+			hasAppKeyHeader: hasAppKey,
+			apiKeyQuery:     req.URL.Query().Get("api_key"),
+			appKeyQuery:     req.URL.Query().Get("application_key"),
+		}
+	}))
+	defer ts.Close()
+
+	credentials, err := spinnakerdatadog.NewCredentials("api", "app")
+	require.NoError(t, err)
+	client := credentials.Client(http.DefaultClient)
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/events?api_key=&application_key=", nil)
+	require.NoError(t, err)
+	req.Header.Set("DD-API-KEY", "")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	r := <-requests
+	assert.Equal(t, "api", r.apiKeyHeader)
+	assert.False(t, r.hasAppKeyHeader, "keys the client didn't send should not be added")
+	assert.Equal(t, "api", r.apiKeyQuery)
+	assert.Equal(t, "app", r.appKeyQuery)
+
+	assert.Empty(t, req.Header.Get("DD-API-KEY"), "the original request should not be modified")
+	assert.Empty(t, req.URL.Query().Get("api_key"), "the original request should not be modified")
+}
@@ -0,0 +1,221 @@
+package spinnakerdatadog
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+// DORASelector selects the pipelines that deploy a service. Application and
+// Pipeline are glob patterns (see path.Match) matched against the application
+// and the pipeline name, an empty pattern matches everything. The service, env
+// and version of the deployment are rendered like unified service tags, and
+// the service defaults to the application.
+type DORASelector struct {
+	Application string `json:"application,omitempty"`
+	Pipeline    string `json:"pipeline,omitempty"`
+	ServiceTags
+}
+
+// DORAConfig lists the pipelines that are reported as deployments, for example:
+//
+//	deployments:
+//	  - application: "hcm"
+//	    pipeline: "Deploy to *"
+//	    env: "prod"
+//	    version: "{{ .Content.Execution.Trigger.Tag }}"
+type DORAConfig struct {
+	Deployments []*DORASelector `json:"deployments"`
+}
+
+// LoadDORAConfig reads the deployment selectors from the given YAML file
+func LoadDORAConfig(file string) (*DORAConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read dora config file")
+	}
+
+	config := new(DORAConfig)
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal dora config file")
+	}
+
+	for _, selector := range config.Deployments {
+		if _, err := path.Match(selector.Application, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid application pattern %q", selector.Application)
+		}
+		if _, err := path.Match(selector.Pipeline, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pipeline pattern %q", selector.Pipeline)
+		}
+		if err := selector.Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// selector returns the first selector matching the pipeline of the webhook
+func (c *DORAConfig) selector(incoming *types.IncomingWebhook) *DORASelector {
+	for _, selector := range c.Deployments {
+		if spinnaker.MatchGlob(selector.Application, incoming.Application()) &&
+			spinnaker.MatchGlob(selector.Pipeline, incoming.Content.Execution.Name) {
+			return selector
+		}
+	}
+
+	return nil
+}
+
+// DORAHandler reports completed deploy pipelines to Datadog's DORA metrics as
+// deployments, and failed deploy pipelines as failures. Cancelled pipelines
+// aren't failures, so they aren't reported
+type DORAHandler struct {
+	api    apiClient
+	config *DORAConfig
+}
+
+var (
+	_ spinnaker.Handler        = (*DORAHandler)(nil)
+	_ spinnaker.ContextHandler = (*DORAHandler)(nil)
+)
+
+// DORAOption configures optional behavior of a DORA handler
+type DORAOption func(*DORAHandler)
+
+// WithDORARecorder records the result of every call to the DORA API with the
+// given recorder
+func WithDORARecorder(r telemetry.Recorder) DORAOption {
+	return func(h *DORAHandler) {
+		h.api.recorder = r
+	}
+}
+
+// WithDORAHTTPClient sends requests to the DORA API with the given client,
+// such as one built by NewHTTPClient
+func WithDORAHTTPClient(c *http.Client) DORAOption {
+	return func(h *DORAHandler) {
+		h.api.client = c
+	}
+}
+
+// NewDORAHandler initializes a handler that reports the pipelines selected by
+// the given config to the Datadog API located at baseURL (DefaultAPIURL when
+// empty) with the given API key
+func NewDORAHandler(baseURL, apiKey string, config *DORAConfig, opts ...DORAOption) *DORAHandler {
+	h := &DORAHandler{
+		api:    newAPIClient("dora api", baseURL, DefaultAPIURL, apiKey),
+		config: config,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// Name implements spinnaker.Handler
+func (h *DORAHandler) Name() string {
+	return "DORAHandler"
+}
+
+// doraHookTypes are the hook types DORA handlers are registered for
+var doraHookTypes = []string{"orca:pipeline:complete", "orca:pipeline:failed"}
+
+// AttachToDispatcher registers the handler for completed and failed pipelines.
+// Use WithDORA instead to only report the pipelines of a spout's org
+func (h *DORAHandler) AttachToDispatcher(d *spinnaker.Dispatcher) {
+	for _, hookType := range doraHookTypes {
+		d.AddHandler(hookType, h)
+	}
+}
+
+// Handle implements spinnaker.Handler
+func (h *DORAHandler) Handle(incoming *types.IncomingWebhook) error {
+	return h.HandleContext(context.Background(), incoming)
+}
+
+// HandleContext implements spinnaker.ContextHandler
+func (h *DORAHandler) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	if incoming.Content.Execution.Canceled {
+		return nil
+	}
+
+	selector := h.config.selector(incoming)
+	if selector == nil {
+		return nil
+	}
+
+	values, err := selector.Values(incoming)
+	if err != nil {
+		return errors.Wrap(err, "could not render deployment")
+	}
+	if values["service"] == "" {
+		values["service"] = incoming.Application()
+	}
+
+	execution := incoming.Content.Execution
+	finished := execution.EndTime.Time
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	started := execution.StartTime.Time
+	if started.IsZero() {
+		started = finished
+	}
+
+	attributes := map[string]interface{}{
+		"id":          incoming.Content.ExecutionID,
+		"started_at":  started.UnixNano(),
+		"finished_at": finished.UnixNano(),
+		"env":         values["env"],
+		"version":     values["version"],
+	}
+	if repositoryURL := execution.Trigger.RepositoryURL(); repositoryURL != "" && execution.Trigger.Hash != "" {
+		attributes["git"] = map[string]string{
+			"repository_url": repositoryURL,
+			"commit_sha":     execution.Trigger.Hash,
+		}
+	}
+
+	endpoint := "deployment"
+	if incoming.Details.Type == "orca:pipeline:failed" {
+		endpoint = "failure"
+		attributes["services"] = []string{values["service"]}
+		attributes["name"] = "Deployment of " + values["service"] + " failed: " + execution.Name
+	} else {
+		attributes["service"] = values["service"]
+	}
+
+	// The DORA API rejects empty values, so unset ones are left out
+	for key, value := range attributes {
+		if s, ok := value.(string); ok && s == "" {
+			delete(attributes, key)
+		}
+	}
+
+	record := map[string]interface{}{
+		"data": map[string]interface{}{"attributes": attributes},
+	}
+	if err := h.api.postJSON(ctx, "/api/v2/dora/"+endpoint, "dora_"+endpoint, record); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"service": values["service"],
+		"env":     values["env"],
+		"record":  endpoint,
+	}).Info("submitted dora record")
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package spinnakerdatadog_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+type doraRecord struct {
+	path       string
+	attributes map[string]interface{}
+}
+
+// decodeDORARecord decodes a request to the DORA API
+func decodeDORARecord(t *testing.T, r apiRequest) doraRecord {
+	var body struct {
+		Data struct {
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	r.decode(t, &body)
+
+	return doraRecord{path: r.Path, attributes: body.Data.Attributes}
+}
+
+func deployWebhook(hookType, app, pipeline string) *types.IncomingWebhook {
+	return &types.IncomingWebhook{
+		Details: types.Details{Application: app, Type: hookType},
+		Content: types.Content{
+			ExecutionID: "01C5ZJ",
+			Execution: types.Execution{
+				Name:      pipeline,
+				StartTime: types.Timestamp{Time: time.Unix(1518214000, 0)},
+				EndTime:   types.Timestamp{Time: time.Unix(1518214010, 0)},
+				Trigger: types.Trigger{
+					Tag:     "v1.2.3",
+					Source:  "github",
+					Project: "namely",
+					Slug:    "hcm",
+					Hash:    "0123abcd",
+				},
+			},
+		},
+	}
+}
+
+func TestLoadDORAConfig(t *testing.T) {
+	wd, _ := os.Getwd()
+
+	config, err := spinnakerdatadog.LoadDORAConfig(filepath.Join(wd, "testdata", "dora.yml"))
+	require.NoError(t, err)
+	require.Len(t, config.Deployments, 2)
+	assert.Equal(t, "Deploy to *", config.Deployments[0].Pipeline)
+	assert.Equal(t, "prod", config.Deployments[0].Env)
+
+	_, err = spinnakerdatadog.LoadDORAConfig(filepath.Join(wd, "testdata", "nope.yml"))
+	assert.Error(t, err)
+}
+
+func TestDORAHandlerSubmitsDeployments(t *testing.T) {
+	wd, _ := os.Getwd()
+	config, err := spinnakerdatadog.LoadDORAConfig(filepath.Join(wd, "testdata", "dora.yml"))
+	require.NoError(t, err)
+
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+	h := spinnakerdatadog.NewDORAHandler(ts.URL, "apikey", config)
+
+	t.Run("Given a completed deploy pipeline", func(t *testing.T) {
+		require.NoError(t, h.Handle(deployWebhook("orca:pipeline:complete", "hcm", "Deploy to prod")))
+
+		record := decodeDORARecord(t, <-requests)
+		assert.Equal(t, "/api/v2/dora/deployment", record.path)
+		assert.Equal(t, "hcm-web", record.attributes["service"])
+		assert.Equal(t, "prod", record.attributes["env"])
+		assert.Equal(t, "v1.2.3", record.attributes["version"])
+		assert.Equal(t, "01C5ZJ", record.attributes["id"])
+		assert.Equal(t, float64(1518214000000000000), record.attributes["started_at"])
+		assert.Equal(t, float64(1518214010000000000), record.attributes["finished_at"])
+		assert.Equal(t, map[string]interface{}{
+			"repository_url": "https://github.com/namely/hcm",
+			"commit_sha":     "0123abcd",
+		}, record.attributes["git"])
+	})
+
+	t.Run("Given a failed deploy pipeline", func(t *testing.T) {
+		require.NoError(t, h.Handle(deployWebhook("orca:pipeline:failed", "billing-api", "Deploy")))
+
+		record := decodeDORARecord(t, <-requests)
+		assert.Equal(t, "/api/v2/dora/failure", record.path)
+		assert.Equal(t, []interface{}{"billing-api"}, record.attributes["services"])
+		assert.NotContains(t, record.attributes, "env")
+		assert.Equal(t, "Deployment of billing-api failed: Deploy", record.attributes["name"])
+	})
+
+	t.Run("Given a version with characters HTML escapes", func(t *testing.T) {
+		incoming := deployWebhook("orca:pipeline:complete", "hcm", "Deploy to prod")
+		incoming.Content.Execution.Trigger.Tag = "1.2.3+build.5"
+		require.NoError(t, h.Handle(incoming))
+
+		record := decodeDORARecord(t, <-requests)
+		assert.Equal(t, "1.2.3+build.5", record.attributes["version"])
+	})
+
+	t.Run("Given a cancelled deploy pipeline", func(t *testing.T) {
+		incoming := deployWebhook("orca:pipeline:failed", "billing-api", "Deploy")
+		incoming.Content.Execution.Canceled = true
+		require.NoError(t, h.Handle(incoming))
+		assert.Empty(t, requests)
+	})
+
+	t.Run("Given a pipeline that isn't selected", func(t *testing.T) {
+		require.NoError(t, h.Handle(deployWebhook("orca:pipeline:complete", "hcm", "Run tests")))
+		assert.Empty(t, requests)
+	})
+}
@@ -2,15 +2,15 @@ package spinnakerdatadog
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 
-	dogstatsd "github.com/DataDog/datadog-go/statsd"
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	datadogAPI "gopkg.in/zorkian/go-datadog-api.v2"
 )
 
 // DatadogEventHandler handles piping all of the registered events (via templates)
@@ -21,7 +21,10 @@ type DatadogEventHandler struct {
 	template *EventTemplate
 }
 
-var _ spinnaker.Handler = (*DatadogEventHandler)(nil)
+var (
+	_ spinnaker.Handler        = (*DatadogEventHandler)(nil)
+	_ spinnaker.ContextHandler = (*DatadogEventHandler)(nil)
+)
 
 // NewDatadogEventHandler initializes a datadog event handler
 func NewDatadogEventHandler(s *Spout, template *EventTemplate) *DatadogEventHandler {
@@ -51,93 +54,176 @@ func removeDuplicateTags(tags []string) []string {
 	return result
 }
 
+// enrichmentTags returns the default tags derived from the Spinnaker
+// application configuration. Tags without a value are skipped
+func enrichmentTags(e types.Enrichment) []string {
+	var tags []string
+
+	if team := e.Application.Attribute("team"); team != "" {
+		tags = append(tags, fmt.Sprintf("team:%s", team))
+	}
+	if e.Application.Email != "" {
+		tags = append(tags, fmt.Sprintf("email:%s", e.Application.Email))
+	}
+	if e.Application.RepoSlug != "" {
+		repo := e.Application.RepoSlug
+		if e.Application.RepoProjectKey != "" {
+			repo = e.Application.RepoProjectKey + "/" + repo
+		}
+		tags = append(tags, fmt.Sprintf("repo:%s", repo))
+	}
+
+	return tags
+}
+
 // Handle implements spinnaker.Handler. It sends datadog events for the given
 // webhook event type. It compiles the given template from the webhook and sends it
 func (deh *DatadogEventHandler) Handle(incoming *types.IncomingWebhook) error {
+	return deh.HandleContext(context.Background(), incoming)
+}
+
+// HandleContext implements spinnaker.ContextHandler. Calls to Gate and to the
+// sinks of the template are cancelled when ctx is done.
+func (deh *DatadogEventHandler) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
 	if err := deh.template.Compile(); err != nil {
 		return errors.Wrap(err, "could not compile template")
 	}
 
-	titleBuf, textBuf := new(bytes.Buffer), new(bytes.Buffer)
-	if err := deh.template.compiledTitle.Execute(titleBuf, incoming); err != nil {
-		return errors.Wrap(err, "could not compile title from webhook")
+	sinks, err := deh.spout.sinksFor(deh.template)
+	if err != nil {
+		return err
 	}
-
-	if err := deh.template.compiledText.Execute(textBuf, incoming); err != nil {
-		return errors.Wrap(err, "could not compile text from webhook")
+	// Templates that only send to the logs or CI Visibility sinks leave it to
+	// their own handlers
+	if len(sinks) == 0 {
+		return nil
 	}
 
-	ddClient, err := dogstatsd.New("127.0.0.1:8125")
+	event, err := deh.spout.renderEvent(ctx, deh.template, incoming)
 	if err != nil {
-		return errors.Wrap(err, "could not open connection to dogstatsd")
+		return err
 	}
+	incoming = event.Webhook
 
-	ddClient.Namespace = "spinnaker."
-
-	event := &datadogAPI.Event{}
-	event.SetTitle(titleBuf.String())
-	event.SetText(textBuf.String())
-	event.SetAggregation(incoming.Content.ExecutionID)
 	eventTypeDetails := strings.Split(incoming.Details.Type, ":")
-	if len(eventTypeDetails) < 3 {
-		return errors.New("could not extract event type details from webhook")
-	}
-
 	eventType := eventTypeDetails[1]
 	eventStatus := eventTypeDetails[2]
 
-	event.Tags = []string{
-		"origin:spinnaker",
-		fmt.Sprintf("app:%s", incoming.Details.Application),
-		fmt.Sprintf("status:%s", eventStatus),
-		fmt.Sprintf("type:%s", eventType),
-		incoming.Details.Type,
-	}
-
-	if eventStatus == "failed" {
-		event.SetAlertType("error")
-	}
-
-	for _, tag := range deh.template.compiledTags {
-		tagBuf := new(bytes.Buffer)
-		if err := tag.Execute(tagBuf, incoming); err != nil {
-			return errors.Wrap(err, "could not compile tags from webhook")
-		}
-		event.Tags = append(event.Tags, tagBuf.String())
-	}
-
-	event.Tags = removeDuplicateTags(event.Tags)
-
 	if eventType == "pipeline" && (eventStatus == "complete" || eventStatus == "failed") {
 		metricTags := []string{
 			fmt.Sprintf("triggered_by:%s", incoming.Content.Execution.Trigger.User),
 			fmt.Sprintf("pipeline_name:%s", incoming.Content.Execution.Name),
 		}
-		metricTags = append(metricTags, event.Tags...)
+		metricTags = deh.spout.normalizeTags(append(metricTags, event.Tags...))
+		metricTags = deh.spout.metricTags("pipeline.duration", metricTags)
 
 		duration := incoming.Content.Execution.EndTime.Sub(incoming.Content.Execution.StartTime.Time)
-		err = ddClient.Timing("pipeline.duration", duration, metricTags, 1)
-
-		if err != nil {
+		metric := &sink.Metric{
+			Name:  "pipeline.duration",
+			Type:  sink.Timing,
+			Value: duration.Seconds() * 1000,
+			Tags:  metricTags,
+		}
+		if err := sinks.SendMetric(ctx, metric); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
-			}).Error("error submitting metric to datadog")
+			}).Error("error submitting metric")
 		} else {
 			logrus.WithFields(logrus.Fields{
 				"metric":   "pipeline.duration",
 				"tags":     metricTags,
 				"duration": duration.Seconds() * 1000,
-			}).Info("submitted metric to datadog")
+				"sinks":    sinks.Name(),
+			}).Info("submitted metric")
 		}
 	}
 
-	if _, err := deh.spout.client.PostEvent(event); err != nil {
-		return errors.Wrap(err, "could not post to datadog API")
+	if err := sinks.SendEvent(ctx, event); err != nil {
+		return errors.Wrap(err, "could not send event")
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"tags": event.Tags,
-	}).Info("submitted event to datadog")
+		"tags":  event.Tags,
+		"sinks": sinks.Name(),
+	}).Info("submitted event")
 
 	return nil
 }
+
+// renderEvent renders the event of the given compiled template for the webhook
+// along with its tags. The webhook is enriched first when that wasn't already
+// attempted, and the event carries the enriched webhook
+func (s *Spout) renderEvent(ctx context.Context, et *EventTemplate, incoming *types.IncomingWebhook) (*sink.Event, error) {
+	// Webhooks are usually enriched by the enricher's handler before this one
+	// runs, so the enricher is only called when that didn't happen. A lookup
+	// that already failed isn't retried, it would only eat into the time left
+	// for the webhook
+	if s.enricher != nil && !incoming.Enrichment.Attempted {
+		enrichment, err := s.enricher.EnrichContext(ctx, incoming)
+		if err != nil {
+			logrus.WithError(err).WithField("app", incoming.Details.Application).Warn("could not enrich webhook")
+		}
+
+		// Templates are rendered from a copy so concurrent handlers for the
+		// same webhook never observe each other's writes
+		enriched := *incoming
+		enriched.Enrichment = enrichment
+		incoming = &enriched
+	}
+
+	titleBuf, textBuf := new(bytes.Buffer), new(bytes.Buffer)
+	if err := et.compiledTitle.Execute(titleBuf, incoming); err != nil {
+		return nil, errors.Wrap(err, "could not compile title from webhook")
+	}
+
+	if err := et.compiledText.Execute(textBuf, incoming); err != nil {
+		return nil, errors.Wrap(err, "could not compile text from webhook")
+	}
+
+	event := &sink.Event{
+		Title:          titleBuf.String(),
+		Text:           textBuf.String(),
+		AggregationKey: incoming.Content.ExecutionID,
+		Webhook:        incoming,
+	}
+	eventTypeDetails := strings.Split(incoming.Details.Type, ":")
+	if len(eventTypeDetails) < 3 {
+		return nil, errors.New("could not extract event type details from webhook")
+	}
+
+	eventType := eventTypeDetails[1]
+	eventStatus := eventTypeDetails[2]
+
+	event.Tags = []string{
+		"origin:spinnaker",
+		fmt.Sprintf("app:%s", incoming.Details.Application),
+		fmt.Sprintf("status:%s", eventStatus),
+		fmt.Sprintf("type:%s", eventType),
+		incoming.Details.Type,
+	}
+	event.Tags = append(event.Tags, enrichmentTags(incoming.Enrichment)...)
+
+	if s.serviceTags != nil {
+		serviceTags, err := s.serviceTags.Tags(incoming)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not compile service tags from webhook")
+		}
+		event.Tags = append(event.Tags, serviceTags...)
+	}
+
+	if eventStatus == "failed" {
+		event.AlertType = "error"
+	}
+
+	for _, tag := range et.compiledTags {
+		tagBuf := new(bytes.Buffer)
+		if err := tag.Execute(tagBuf, incoming); err != nil {
+			return nil, errors.Wrap(err, "could not compile tags from webhook")
+		}
+		event.Tags = append(event.Tags, tagBuf.String())
+	}
+
+	event.Tags = s.normalizeTags(removeDuplicateTags(event.Tags))
+
+	return event, nil
+}
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -351,3 +352,96 @@ func TestEventDispatcherRemovesDuplicateTags(t *testing.T) {
 		t.Error("timed out waiting for webhook call")
 	}
 }
+
+func TestEventDispatcherEnrichesEvents(t *testing.T) {
+	gate := http.NewServeMux()
+	gate.HandleFunc("/applications/someapp", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`{"name":"someapp","attributes":{"email":"owner@test.tld","repoProjectKey":"org","repoSlug":"someapp","team":"platform"}}`))
+	})
+	gate.HandleFunc("/applications/someapp/pipelineConfigs", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`[{"id":"c6f20df7-f9ab-45b5-b525-9a67ef2e95b5","name":"Deploy"}]`))
+	})
+	gs := httptest.NewServer(gate)
+	defer gs.Close()
+
+	mux := http.NewServeMux()
+	var event datadog.Event
+	done := make(chan error, 1)
+	mux.HandleFunc("/api/v1/events", func(_ http.ResponseWriter, req *http.Request) {
+		done <- json.NewDecoder(req.Body).Decode(&event)
+	})
+	ts := httptest.NewServer(mux)
+	os.Setenv("DATADOG_HOST", ts.URL)
+	defer os.Unsetenv("DATADOG_HOST")
+
+	enricher := spinnaker.NewEnricher(gs.URL, time.Minute)
+	spout, _ := spinnakerdatadog.NewSpout(datadog.NewClient("", ""), "", spinnakerdatadog.WithEnricher(enricher))
+	template := &spinnakerdatadog.EventTemplate{
+		Title: "{{ .Enrichment.Pipeline.Name }} doing something",
+		Text:  "owned by {{ .Enrichment.Application.Email }}",
+	}
+
+	handler := spinnakerdatadog.NewDatadogEventHandler(spout, template)
+	err := handler.Handle(&types.IncomingWebhook{
+		Details: types.Details{
+			Application: "someapp",
+			Type:        "orca:stage:complete",
+		},
+		Content: types.Content{
+			ExecutionID: "someid",
+			Execution: types.Execution{
+				PipelineConfigID: "c6f20df7-f9ab-45b5-b525-9a67ef2e95b5",
+			},
+		},
+	})
+
+	require.NoError(t, err)
+
+	select {
+	case err := <-done:
+		require.NoError(t, err, "error handling webhook")
+
+		assert.Equal(t, "Deploy doing something", event.GetTitle())
+		assert.Equal(t, "owned by owner@test.tld", event.GetText())
+		assert.Contains(t, event.Tags, "team:platform")
+		assert.Contains(t, event.Tags, "email:owner@test.tld")
+		assert.Contains(t, event.Tags, "repo:org/someapp")
+	case <-time.After(time.Millisecond * 100):
+		t.Error("timed out waiting for webhook call")
+	}
+}
+
+func TestEventDispatcherDoesNotRetryFailedEnrichment(t *testing.T) {
+	var gateCalls int32
+	gs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&gateCalls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer gs.Close()
+
+	mux := http.NewServeMux()
+	done := make(chan struct{}, 1)
+	mux.HandleFunc("/api/v1/events", func(_ http.ResponseWriter, _ *http.Request) {
+		done <- struct{}{}
+	})
+	ts := httptest.NewServer(mux)
+	os.Setenv("DATADOG_HOST", ts.URL)
+	defer os.Unsetenv("DATADOG_HOST")
+
+	enricher := spinnaker.NewEnricher(gs.URL, time.Minute)
+	spout, _ := spinnakerdatadog.NewSpout(datadog.NewClient("", ""), "", spinnakerdatadog.WithEnricher(enricher))
+	handler := spinnakerdatadog.NewDatadogEventHandler(spout, &spinnakerdatadog.EventTemplate{Title: "title", Text: "text"})
+
+	incoming := &types.IncomingWebhook{
+		Details: types.Details{Application: "someapp", Type: "orca:stage:complete"},
+	}
+	require.Error(t, enricher.Handler().Handle(incoming))
+	require.NoError(t, handler.Handle(incoming))
+
+	select {
+	case <-done:
+		assert.Equal(t, int32(1), atomic.LoadInt32(&gateCalls), "gate should only be called by the enricher")
+	case <-time.After(time.Millisecond * 100):
+		t.Error("timed out waiting for webhook call")
+	}
+}
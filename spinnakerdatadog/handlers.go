@@ -2,9 +2,18 @@ package spinnakerdatadog
 
 import (
 	"html/template"
+	"io"
 	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
+	dogstatsd "github.com/DataDog/datadog-go/statsd"
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
 	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
 	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
 	datadog "gopkg.in/zorkian/go-datadog-api.v2"
@@ -15,6 +24,145 @@ import (
 type Spout struct {
 	client         *datadog.Client
 	eventTemplates map[string]*EventTemplate
+	enricher       *spinnaker.Enricher
+	serviceTags    *ServiceTags
+	tagNormalizer  *TagNormalizer
+
+	statsd          *dogstatsd.Client
+	metricTagPolicy *MetricTagPolicy
+	recorder        telemetry.Recorder
+
+	// sinks are the destinations of rendered events and metrics by name. The
+	// Datadog sink is always first
+	sinks      []sink.Sink
+	extraSinks []sink.Sink
+
+	// logs receives every webhook, whether a template is defined for its hook
+	// type or not
+	logs *LogsSink
+
+	// ciVisibility receives every finished pipeline, stage and task webhook
+	ciVisibility *CIVisibilitySink
+
+	// dora reports the deploy pipelines of the org to DORA metrics
+	dora *DORAHandler
+
+	// routes send the webhooks they select to the spout of another Datadog
+	// org instead of this one
+	routes []spoutRoute
+}
+
+type spoutRoute struct {
+	route *Route
+	spout *Spout
+}
+
+// DefaultStatsdAddr is the address of the DogStatsD agent metrics are sent to
+// when no client is given to the spout
+const DefaultStatsdAddr = "127.0.0.1:8125"
+
+// statsdNamespace prefixes every metric sent by the spout. It is added to the
+// metric names rather than set on the client so the client can be shared
+const statsdNamespace = "spinnaker."
+
+// SpoutOption configures optional behavior of a spout
+type SpoutOption func(*Spout)
+
+// WithEnricher makes the spout look up application and pipeline configuration
+// from Spinnaker for every webhook. The result is available to templates as
+// .Enrichment and is added to the default tags of events
+func WithEnricher(e *spinnaker.Enricher) SpoutOption {
+	return func(s *Spout) {
+		s.enricher = e
+	}
+}
+
+// WithServiceTags adds the unified service tags (service, env and version)
+// rendered from the given mapping to every event and metric the spout sends
+func WithServiceTags(st *ServiceTags) SpoutOption {
+	return func(s *Spout) {
+		s.serviceTags = st
+	}
+}
+
+// WithTagNormalizer normalizes every event and metric tag the spout sends
+// with the given normalizer
+func WithTagNormalizer(n *TagNormalizer) SpoutOption {
+	return func(s *Spout) {
+		s.tagNormalizer = n
+	}
+}
+
+// WithStatsd sets the DogStatsD client metrics are sent with. By default the
+// spout sends metrics to a DogStatsD agent listening on DefaultStatsdAddr
+func WithStatsd(c *dogstatsd.Client) SpoutOption {
+	return func(s *Spout) {
+		s.statsd = c
+	}
+}
+
+// WithRecorder records the result of every call to the Datadog API with the
+// given recorder
+func WithRecorder(r telemetry.Recorder) SpoutOption {
+	return func(s *Spout) {
+		s.recorder = r
+	}
+}
+
+// WithMetricTagPolicy restricts the tags sent with metrics according to the
+// given policy to keep their cardinality in check
+func WithMetricTagPolicy(p *MetricTagPolicy) SpoutOption {
+	return func(s *Spout) {
+		s.metricTagPolicy = p
+	}
+}
+
+// WithSink sends the events and metrics of every template that doesn't list
+// its sinks to the given sink as well as to Datadog. Templates that list their
+// sinks can refer to it by its name
+func WithSink(sk sink.Sink) SpoutOption {
+	return func(s *Spout) {
+		s.extraSinks = append(s.extraSinks, sk)
+	}
+}
+
+// WithLogs sends every webhook to the given logs sink, rendered with the
+// template of its hook type or with a default title when there is none.
+// Templates listing the logs sink in their sinks don't send to it twice
+func WithLogs(ls *LogsSink) SpoutOption {
+	return func(s *Spout) {
+		s.logs = ls
+	}
+}
+
+// WithCIVisibility sends every pipeline, stage and task webhook of a finished
+// execution to the given CI Visibility sink, whether a template is defined for
+// its hook type or not. Templates listing the CI Visibility sink in their sinks
+// don't send to it twice
+func WithCIVisibility(cs *CIVisibilitySink) SpoutOption {
+	return func(s *Spout) {
+		s.ciVisibility = cs
+	}
+}
+
+// WithDORA reports completed and failed pipelines with the given DORA handler.
+// Like the other handlers of the spout, it only handles the webhooks no route
+// selects
+func WithDORA(h *DORAHandler) SpoutOption {
+	return func(s *Spout) {
+		s.dora = h
+	}
+}
+
+// WithRoute hands the webhooks selected by the given route to the given spout,
+// which usually sends to another Datadog org with its own templates. The first
+// route added that selects a webhook wins, and webhooks no route selects are
+// handled by this spout. The route spout is closed along with this one and
+// should share its DogStatsD client
+func WithRoute(route *Route, rs *Spout) SpoutOption {
+	return func(s *Spout) {
+		s.routes = append(s.routes, spoutRoute{route: route, spout: rs})
+	}
 }
 
 // EventTemplate is the representation in the template file
@@ -23,18 +171,29 @@ type EventTemplate struct {
 	Title string   `json:"title,omitempty"`
 	Text  string   `json:"text,omitempty"`
 	Tags  []string `json:"tags,omitempty"`
+	// Sinks are the names of the sinks the event is sent to. It is sent to
+	// every sink of the spout when empty
+	Sinks []string `json:"sinks,omitempty"`
 
 	compiledTitle *template.Template
 	compiledText  *template.Template
 	compiledTags  []*template.Template
 	isCompiled    bool
+	mu            sync.Mutex
 }
 
+// Compile parses the title, text and tags of the template. It is safe to call
+// concurrently and only parses the template once
 func (et *EventTemplate) Compile() error {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+
 	if et.isCompiled {
 		return nil
 	}
 
+	et.compiledTags = nil
+
 	var err error
 	et.compiledTitle, err = template.New("eventTitle").Parse(et.Title)
 	if err != nil {
@@ -53,13 +212,27 @@ func (et *EventTemplate) Compile() error {
 		}
 		et.compiledTags = append(et.compiledTags, compiledTag)
 	}
-	return err
+
+	et.isCompiled = true
+	return nil
 }
 
 // NewSpout initializes a new spout for spitting out datadog events from
 // Spinnaker event webhooks
-func NewSpout(c *datadog.Client, templateFile string) (*Spout, error) {
-	spout := &Spout{client: c}
+func NewSpout(c *datadog.Client, templateFile string, opts ...SpoutOption) (*Spout, error) {
+	spout := &Spout{client: c, recorder: telemetry.Nop{}}
+	for _, opt := range opts {
+		opt(spout)
+	}
+
+	if spout.statsd == nil {
+		statsd, err := dogstatsd.New(DefaultStatsdAddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open connection to dogstatsd")
+		}
+		spout.statsd = statsd
+	}
+	spout.sinks = append([]sink.Sink{NewDatadogSink(c, spout.statsd, spout.recorder)}, spout.extraSinks...)
 
 	if templateFile == "" {
 		return spout, nil
@@ -79,6 +252,202 @@ func NewSpout(c *datadog.Client, templateFile string) (*Spout, error) {
 	return spout, nil
 }
 
+// normalizeTags applies the tag normalizer of the spout (if any) to the given tags
+func (s *Spout) normalizeTags(tags []string) []string {
+	if s.tagNormalizer == nil {
+		return tags
+	}
+
+	return s.tagNormalizer.Normalize(tags)
+}
+
+// metricTags applies the metric tag policy of the spout (if any) to the tags
+// of the given metric. Every distinct tag value collapsed by the policy is
+// reported to the recorder so the amount of dropped series is visible
+func (s *Spout) metricTags(metric string, tags []string) []string {
+	if s.metricTagPolicy == nil {
+		return tags
+	}
+
+	tags, collapsed := s.metricTagPolicy.Apply(metric, tags)
+	for _, key := range collapsed {
+		s.recorder.MetricTagsCollapsed(metric, key)
+	}
+
+	return tags
+}
+
+// sinksFor returns the sinks the given template sends to
+func (s *Spout) sinksFor(et *EventTemplate) (sink.Fanout, error) {
+	if len(et.Sinks) == 0 {
+		return sink.Fanout(s.sinks), nil
+	}
+
+	var sinks sink.Fanout
+	for _, name := range et.Sinks {
+		// The logs sink gets every webhook from its own handler
+		if s.logs != nil && name == LogsSinkName {
+			continue
+		}
+		// So does the CI Visibility sink
+		if s.ciVisibility != nil && name == CIVisibilitySinkName {
+			continue
+		}
+
+		found := false
+		for _, sk := range s.sinks {
+			if sk.Name() == name {
+				sinks = append(sinks, sk)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("unknown sink %q", name)
+		}
+	}
+
+	return sinks, nil
+}
+
+// route returns the route selecting the given webhook, nil when it is handled
+// by this spout
+func (s *Spout) route(incoming *types.IncomingWebhook) *Route {
+	for _, r := range s.routes {
+		if r.route.Matches(incoming) {
+			return r.route
+		}
+	}
+
+	return nil
+}
+
+// Close flushes any buffered metrics and closes the DogStatsD client of the
+// spout, along with every sink that needs closing and the spouts of its routes
+func (s *Spout) Close() error {
+	errs := s.closeSinks()
+	for _, r := range s.routes {
+		if r.spout.statsd == s.statsd {
+			errs = append(errs, r.spout.closeSinks()...)
+		} else if err := r.spout.Close(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "could not close route %s", r.route.Name))
+		}
+	}
+
+	if err := s.statsd.Close(); err != nil {
+		errs = append(errs, errors.Wrap(err, "could not close dogstatsd client"))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// closeSinks closes every sink of the spout that needs closing
+func (s *Spout) closeSinks() sink.Errors {
+	var errs sink.Errors
+	for _, sk := range s.sinks {
+		if closer, ok := sk.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, errors.Wrapf(err, "could not close %s sink", sk.Name()))
+			}
+		}
+	}
+	if s.logs != nil {
+		if err := s.logs.Close(); err != nil {
+			errs = append(errs, errors.Wrap(err, "could not close logs sink"))
+		}
+	}
+
+	return errs
+}
+
+// CompileTemplates compiles every event template of the spout and returns the
+// first error encountered
+func (s *Spout) CompileTemplates() error {
+	for hookType, eventTemplate := range s.eventTemplates {
+		if err := eventTemplate.Compile(); err != nil {
+			return errors.Wrapf(err, "could not compile template for %s", hookType)
+		}
+		if _, err := s.sinksFor(eventTemplate); err != nil {
+			return errors.Wrapf(err, "invalid template for %s", hookType)
+		}
+	}
+
+	for _, r := range s.routes {
+		if err := r.spout.CompileTemplates(); err != nil {
+			return errors.Wrapf(err, "route %s", r.route.Name)
+		}
+	}
+
+	return nil
+}
+
+// CheckStatsd checks that the DogStatsD agent listening at the given address
+// (as given to dogstatsd.New) can be reached without sending it any metric.
+// Over UDP an empty datagram is sent, which the agent ignores, so this can
+// only detect an agent that is missing on the local host
+func CheckStatsd(addr string) error {
+	network := "udp"
+	if strings.HasPrefix(addr, unixAddressPrefix) {
+		network, addr = "unixgram", strings.TrimPrefix(addr, unixAddressPrefix)
+	}
+
+	conn, err := net.DialTimeout(network, addr, statsdCheckTimeout)
+	if err != nil {
+		return errors.Wrap(err, "could not reach dogstatsd")
+	}
+	defer conn.Close()
+
+	if network != "udp" {
+		return nil
+	}
+
+	// A missing agent is reported by the next read once the host answered
+	// the datagram with port unreachable. Timing out means nothing refused it
+	if _, err := conn.Write(nil); err != nil {
+		return errors.Wrap(err, "could not reach dogstatsd")
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(statsdCheckTimeout)); err != nil {
+		return errors.Wrap(err, "could not reach dogstatsd")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return errors.Wrap(err, "could not reach dogstatsd")
+	}
+
+	return nil
+}
+
+// unixAddressPrefix marks DogStatsD addresses that are unix sockets
+const unixAddressPrefix = "unix://"
+
+// statsdCheckTimeout bounds how long CheckStatsd waits for the agent
+const statsdCheckTimeout = 100 * time.Millisecond
+
+// ValidateAPIKey checks the Datadog API key of the spout against the Datadog API
+func (s *Spout) ValidateAPIKey() error {
+	valid, err := s.client.Validate()
+	if err != nil {
+		return errors.Wrap(err, "could not validate datadog api key")
+	}
+
+	if !valid {
+		return errors.New("datadog api key is not valid")
+	}
+
+	for _, r := range s.routes {
+		if err := r.spout.ValidateAPIKey(); err != nil {
+			return errors.Wrapf(err, "route %s", r.route.Name)
+		}
+	}
+
+	return nil
+}
+
 // TotalTemplates returns how many templates are currently registered
 // for events
 func (s *Spout) TotalTemplates() int {
@@ -93,6 +462,49 @@ func (s *Spout) Handlers() map[string][]spinnaker.Handler {
 		hs[hookType] = []spinnaker.Handler{
 			&DatadogEventHandler{spout: s, template: eventTemplate},
 		}
+		if s.enricher != nil {
+			hs[hookType] = append(hs[hookType], s.enricher.Handler())
+		}
+	}
+	if s.logs != nil {
+		hs[spinnaker.AnyHookType] = []spinnaker.Handler{&logsHandler{spout: s}}
+	}
+	if s.ciVisibility != nil {
+		for _, hookType := range ciVisibilityHookTypes {
+			hs[hookType] = append(hs[hookType], &ciVisibilityHandler{sink: s.ciVisibility})
+		}
+	}
+	if s.dora != nil {
+		for _, hookType := range doraHookTypes {
+			hs[hookType] = append(hs[hookType], s.dora)
+		}
+	}
+
+	if len(s.routes) == 0 {
+		return hs
+	}
+
+	// Every webhook is handled by the spout of its route only
+	for hookType, handlers := range hs {
+		for i, h := range handlers {
+			handlers[i] = filterHandler(h, "", func(incoming *types.IncomingWebhook) bool {
+				return s.route(incoming) == nil
+			})
+		}
+		hs[hookType] = handlers
+	}
+	// Handlers of a route are named after it so disabling or timing out the
+	// handler of one org doesn't affect the others
+	for _, r := range s.routes {
+		route := r.route
+		for hookType, handlers := range r.spout.Handlers() {
+			for _, h := range handlers {
+				name := h.Name() + "@" + route.Name
+				hs[hookType] = append(hs[hookType], filterHandler(h, name, func(incoming *types.IncomingWebhook) bool {
+					return s.route(incoming) == route
+				}))
+			}
+		}
 	}
 
 	return hs
@@ -1,9 +1,11 @@
 package spinnakerdatadog_test
 
 import (
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
 	"github.com/stretchr/testify/assert"
@@ -68,3 +70,24 @@ func TestCompilingTemplateTagsError(t *testing.T) {
 	err := tmpl.Compile()
 	require.Error(t, err)
 }
+
+func TestCheckStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+
+	t.Run("Given a listening agent", func(t *testing.T) {
+		assert.NoError(t, spinnakerdatadog.CheckStatsd(addr))
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		n, _, err := conn.ReadFrom(make([]byte, 1024))
+		if err == nil {
+			assert.Zero(t, n, "no metric should be sent")
+		}
+	})
+
+	t.Run("Given a missing agent", func(t *testing.T) {
+		require.NoError(t, conn.Close())
+		assert.Error(t, spinnakerdatadog.CheckStatsd(addr))
+	})
+}
@@ -0,0 +1,406 @@
+package spinnakerdatadog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+// LogsSinkName is the name templates use to send to the logs sink
+const LogsSinkName = "logs"
+
+// Defaults of the logs sink when no options are given
+const (
+	DefaultLogsBatchSize     = 100
+	DefaultLogsFlushInterval = 5 * time.Second
+	DefaultLogsMaxBuffered   = 10000
+)
+
+// Limits of the logs intake on the size of a single log and of a request,
+// before compression
+const (
+	maxLogSize       = 1 << 20
+	maxLogsBatchSize = 5 << 20
+)
+
+// redactedValue replaces the values of redacted keys
+const redactedValue = "[redacted]"
+
+// LogsSink sends every event, along with the webhook it was rendered from, to
+// the Datadog logs HTTP intake as a structured log. Logs are sent in gzipped
+// batches once a batch is full or the flush interval elapses, and when the
+// sink is closed. Batches the intake couldn't take because it was unreachable,
+// rate limiting or failing are sent again at the next flush interval, and logs
+// are dropped while too many are waiting to be sent. Metrics and service
+// checks are ignored.
+type LogsSink struct {
+	api           apiClient
+	redactKeys    []string
+	batchSize     int
+	maxBuffered   int
+	flushInterval time.Duration
+
+	mu       sync.Mutex
+	buffered []json.RawMessage
+
+	// full is signaled when a batch is full so the flush loop sends it
+	// without waiting for the flush interval
+	full    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var _ sink.Sink = (*LogsSink)(nil)
+
+// LogsOption configures optional behavior of a logs sink
+type LogsOption func(*LogsSink)
+
+// WithRedactedKeys replaces the values of every key of the webhook containing
+// one of the given strings (case insensitive), such as "password" or "token"
+func WithRedactedKeys(keys ...string) LogsOption {
+	return func(s *LogsSink) {
+		for _, key := range keys {
+			s.redactKeys = append(s.redactKeys, strings.ToLower(key))
+		}
+	}
+}
+
+// WithLogsBatch sets how many logs are sent at once and how often logs are
+// sent when a batch doesn't fill up
+func WithLogsBatch(size int, interval time.Duration) LogsOption {
+	return func(s *LogsSink) {
+		s.batchSize = size
+		s.flushInterval = interval
+	}
+}
+
+// WithLogsMaxBuffered sets how many logs can wait to be sent before new ones
+// are dropped
+func WithLogsMaxBuffered(n int) LogsOption {
+	return func(s *LogsSink) {
+		s.maxBuffered = n
+	}
+}
+
+// WithLogsRecorder records the result of every call to the logs intake with
+// the given recorder
+func WithLogsRecorder(r telemetry.Recorder) LogsOption {
+	return func(s *LogsSink) {
+		s.api.recorder = r
+	}
+}
+
+// WithLogsHTTPClient sends requests to the logs intake with the given client,
+// such as one built by NewHTTPClient
+func WithLogsHTTPClient(c *http.Client) LogsOption {
+	return func(s *LogsSink) {
+		s.api.client = c
+	}
+}
+
+// NewLogsSink initializes a sink that sends to the logs intake located at
+// baseURL (DefaultLogsURL when empty) with the given API key. The sink must be
+// closed to send the logs that are still buffered
+func NewLogsSink(baseURL, apiKey string, opts ...LogsOption) *LogsSink {
+	s := &LogsSink{
+		api:           newAPIClient("logs intake", baseURL, DefaultLogsURL, apiKey),
+		batchSize:     DefaultLogsBatchSize,
+		maxBuffered:   DefaultLogsMaxBuffered,
+		flushInterval: DefaultLogsFlushInterval,
+		full:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	go s.flushLoop()
+
+	return s
+}
+
+// Name implements sink.Sink
+func (s *LogsSink) Name() string {
+	return LogsSinkName
+}
+
+// SendMetric implements sink.Sink. Metrics aren't logged, so it does nothing
+func (s *LogsSink) SendMetric(context.Context, *sink.Metric) error {
+	return nil
+}
+
+// SendServiceCheck implements sink.Sink. Service checks aren't logged, so it
+// does nothing
+func (s *LogsSink) SendServiceCheck(context.Context, *sink.ServiceCheck) error {
+	return nil
+}
+
+// SendEvent implements sink.Sink. The log is added to the current batch, so
+// errors sending it are only logged. An error is returned when the log can't
+// be buffered
+func (s *LogsSink) SendEvent(ctx context.Context, event *sink.Event) error {
+	entry := map[string]interface{}{
+		"ddsource": "spinnaker",
+		"service":  "spinnaker",
+		"ddtags":   strings.Join(event.Tags, ","),
+		"message":  event.Title,
+		"title":    event.Title,
+		"text":     event.Text,
+	}
+	for _, tag := range event.Tags {
+		if strings.HasPrefix(tag, "service:") {
+			entry["service"] = strings.TrimPrefix(tag, "service:")
+		}
+	}
+	if event.AlertType != "" {
+		entry["status"] = event.AlertType
+	}
+	if event.Webhook != nil {
+		webhook, err := s.redact(event.Webhook)
+		if err != nil {
+			return err
+		}
+		entry["webhook"] = webhook
+		entry["hook_type"] = event.Webhook.Details.Type
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "could not encode log")
+	}
+	// The webhook is what makes a log too large for the intake, so the log is
+	// sent without it rather than not at all
+	if len(b) > maxLogSize && entry["webhook"] != nil {
+		delete(entry, "webhook")
+		entry["webhook_truncated"] = true
+		if b, err = json.Marshal(entry); err != nil {
+			return errors.Wrap(err, "could not encode log")
+		}
+	}
+	if len(b) > maxLogSize {
+		return errors.Errorf("log of %d bytes is larger than the intake accepts", len(b))
+	}
+
+	s.mu.Lock()
+	if len(s.buffered) >= s.maxBuffered {
+		s.mu.Unlock()
+		return errors.Errorf("%d logs are waiting to be sent, dropping log", s.maxBuffered)
+	}
+	s.buffered = append(s.buffered, b)
+	full := len(s.buffered) >= s.batchSize
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// redact returns the webhook as generic JSON with the values of the redacted
+// keys replaced
+func (s *LogsSink) redact(webhook interface{}) (interface{}, error) {
+	b, err := json.Marshal(webhook)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode webhook")
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, errors.Wrap(err, "could not decode webhook")
+	}
+
+	if len(s.redactKeys) == 0 {
+		return v, nil
+	}
+
+	return s.redactValue(v), nil
+}
+
+func (s *LogsSink) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s.isRedacted(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = s.redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = s.redactValue(value)
+		}
+	}
+
+	return v
+}
+
+func (s *LogsSink) isRedacted(key string) bool {
+	key = strings.ToLower(key)
+	for _, redacted := range s.redactKeys {
+		if strings.Contains(key, redacted) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flushLoop sends the buffered logs whenever the flush interval elapses or a
+// batch is full, until the sink is closed. After a failure, logs are only sent
+// again at the next flush interval so a failing intake isn't hammered
+func (s *LogsSink) flushLoop() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	var failing bool
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.full:
+			if failing {
+				continue
+			}
+		case <-s.stop:
+			return
+		}
+
+		err := s.Flush(context.Background())
+		if err != nil {
+			logrus.WithError(err).Error("could not send logs to datadog")
+		}
+		failing = err != nil
+	}
+}
+
+// Flush sends the logs that are buffered, in as many batches as needed. A
+// batch that failed with an error that may go away is kept to be sent again
+func (s *LogsSink) Flush(ctx context.Context) error {
+	for {
+		batch := s.nextBatch()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := s.send(ctx, batch); err != nil {
+			if retryable(err) {
+				s.mu.Lock()
+				s.buffered = append(batch, s.buffered...)
+				s.mu.Unlock()
+			}
+			return errors.Wrapf(err, "could not send %d logs", len(batch))
+		}
+	}
+}
+
+// nextBatch takes the oldest buffered logs that fit in a batch, by count and
+// by size
+func (s *LogsSink) nextBatch() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Logs are encoded as a JSON array, so each log takes a comma on top of
+	// its own size and the array takes its brackets
+	size := 2
+	n := 0
+	for n < len(s.buffered) && n < s.batchSize {
+		size += len(s.buffered[n]) + 1
+		if n > 0 && size > maxLogsBatchSize {
+			break
+		}
+		n++
+	}
+
+	batch := s.buffered[:n:n]
+	s.buffered = s.buffered[n:]
+
+	return batch
+}
+
+// send sends the given logs in a single request
+func (s *LogsSink) send(ctx context.Context, batch []json.RawMessage) error {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	if err := json.NewEncoder(gz).Encode(batch); err != nil {
+		return errors.Wrap(err, "could not encode logs")
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "could not compress logs")
+	}
+
+	return s.api.post(ctx, "/api/v2/logs", "logs", buf.Bytes(), http.Header{"Content-Encoding": {"gzip"}})
+}
+
+// Close stops sending logs periodically and sends the logs that are buffered.
+// It waits for a flush that is in progress
+func (s *LogsSink) Close() error {
+	close(s.stop)
+	<-s.stopped
+
+	return s.Flush(context.Background())
+}
+
+// defaultLogTemplate renders the logs of webhooks without a template
+var defaultLogTemplate = &EventTemplate{
+	Title: "{{ .Details.Type }} for {{ .Details.Application }}",
+}
+
+// logsHandler sends every webhook to the logs sink of a spout, rendered with
+// the template of its hook type or with defaultLogTemplate, along with the tags
+// events would have
+type logsHandler struct {
+	spout *Spout
+}
+
+var (
+	_ spinnaker.Handler        = (*logsHandler)(nil)
+	_ spinnaker.ContextHandler = (*logsHandler)(nil)
+)
+
+// Name implements spinnaker.Handler
+func (h *logsHandler) Name() string {
+	return "LogsHandler"
+}
+
+// Handle implements spinnaker.Handler
+func (h *logsHandler) Handle(incoming *types.IncomingWebhook) error {
+	return h.HandleContext(context.Background(), incoming)
+}
+
+// HandleContext implements spinnaker.ContextHandler
+func (h *logsHandler) HandleContext(ctx context.Context, incoming *types.IncomingWebhook) error {
+	et, ok := h.spout.eventTemplates[incoming.Details.Type]
+	if !ok {
+		et = defaultLogTemplate
+	}
+	if err := et.Compile(); err != nil {
+		return errors.Wrap(err, "could not compile template")
+	}
+
+	event, err := h.spout.renderEvent(ctx, et, incoming)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(h.spout.logs.SendEvent(ctx, event), "could not log webhook")
+}
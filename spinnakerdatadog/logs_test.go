@@ -0,0 +1,206 @@
+package spinnakerdatadog_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+// logsBatch decodes a batch of logs sent to the logs intake
+func logsBatch(t *testing.T, r apiRequest) []map[string]interface{} {
+	assert.Equal(t, "/api/v2/logs", r.Path)
+
+	var batch []map[string]interface{}
+	r.decode(t, &batch)
+
+	return batch
+}
+
+func logEvent(title string) *sink.Event {
+	return &sink.Event{
+		Title:     title,
+		Text:      "some text",
+		AlertType: "error",
+		Tags:      []string{"app:hcm", "service:hcm-web"},
+		Webhook: &types.IncomingWebhook{
+			Details: types.Details{Application: "hcm", Type: "orca:stage:failed"},
+			Content: types.Content{
+				ExecutionID: "01C5ZJ",
+				Context: map[string]interface{}{
+					"account": "prod",
+					"parameters": map[string]interface{}{
+						"dbPassword": "hunter2",
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestLogsSinkSendsBatches(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewLogsSink(ts.URL, "apikey", spinnakerdatadog.WithLogsBatch(2, time.Hour))
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("first")))
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("second")))
+
+	var batch []map[string]interface{}
+	select {
+	case r := <-requests:
+		batch = logsBatch(t, r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("full batch was not sent")
+	}
+	require.Len(t, batch, 2)
+
+	titles := []interface{}{batch[0]["title"], batch[1]["title"]}
+	assert.ElementsMatch(t, []interface{}{"first", "second"}, titles)
+	assert.Equal(t, "spinnaker", batch[0]["ddsource"])
+	assert.Equal(t, "hcm-web", batch[0]["service"])
+	assert.Equal(t, "app:hcm,service:hcm-web", batch[0]["ddtags"])
+	assert.Equal(t, "error", batch[0]["status"])
+	assert.Equal(t, "orca:stage:failed", batch[0]["hook_type"])
+
+	webhook := batch[0]["webhook"].(map[string]interface{})
+	assert.Equal(t, "01C5ZJ", webhook["content"].(map[string]interface{})["executionId"])
+
+	require.NoError(t, s.Close())
+	assert.Empty(t, requests, "no logs should be left to send on close")
+}
+
+func TestLogsSinkFlushesOnClose(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewLogsSink(ts.URL, "apikey")
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("only")))
+	require.NoError(t, s.Close())
+
+	batch := logsBatch(t, <-requests)
+	require.Len(t, batch, 1)
+	assert.Equal(t, "only", batch[0]["message"])
+}
+
+func TestLogsSinkRedactsKeys(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewLogsSink(ts.URL, "apikey", spinnakerdatadog.WithRedactedKeys("PASSWORD"))
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("redacted")))
+	require.NoError(t, s.Close())
+
+	batch := logsBatch(t, <-requests)
+	require.Len(t, batch, 1)
+
+	context := batch[0]["webhook"].(map[string]interface{})["content"].(map[string]interface{})["context"].(map[string]interface{})
+	assert.Equal(t, "prod", context["account"])
+	assert.Equal(t, "[redacted]", context["parameters"].(map[string]interface{})["dbPassword"])
+}
+
+func TestLogsSinkReportsIntakeErrors(t *testing.T) {
+	ts, requests := newFakeAPI(t, http.StatusForbidden)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewLogsSink(ts.URL, "apikey", spinnakerdatadog.WithLogsBatch(10, time.Hour))
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("rejected")))
+	assert.Error(t, s.Flush(context.Background()))
+	<-requests
+
+	require.NoError(t, s.Close())
+	assert.Empty(t, requests, "rejected logs should not be sent again")
+}
+
+func TestLogsSinkRetriesFailedBatches(t *testing.T) {
+	ts, requests := newFakeAPI(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewLogsSink(ts.URL, "apikey", spinnakerdatadog.WithLogsBatch(10, time.Hour))
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("retried")))
+	assert.Error(t, s.Flush(context.Background()))
+	assert.Error(t, s.Flush(context.Background()))
+	require.NoError(t, s.Close())
+
+	for i := 0; i < 3; i++ {
+		batch := logsBatch(t, <-requests)
+		require.Len(t, batch, 1)
+		assert.Equal(t, "retried", batch[0]["title"])
+	}
+}
+
+func TestLogsSinkLimitsBatchSize(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewLogsSink(ts.URL, "apikey", spinnakerdatadog.WithLogsBatch(10, time.Hour))
+	for i := 0; i < 6; i++ {
+		event := logEvent("large")
+		event.Text = strings.Repeat("a", 900<<10)
+		require.NoError(t, s.SendEvent(context.Background(), event))
+	}
+	require.NoError(t, s.Close())
+
+	assert.Len(t, logsBatch(t, <-requests), 5)
+	assert.Len(t, logsBatch(t, <-requests), 1)
+}
+
+func TestLogsSinkDropsLogsWhenFull(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	s := spinnakerdatadog.NewLogsSink(ts.URL, "apikey",
+		spinnakerdatadog.WithLogsBatch(10, time.Hour),
+		spinnakerdatadog.WithLogsMaxBuffered(2),
+	)
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("first")))
+	require.NoError(t, s.SendEvent(context.Background(), logEvent("second")))
+	assert.Error(t, s.SendEvent(context.Background(), logEvent("dropped")))
+
+	large := logEvent("large")
+	large.Text = strings.Repeat("a", 2<<20)
+	assert.Error(t, s.SendEvent(context.Background(), large), "logs larger than the intake accepts should be rejected")
+
+	require.NoError(t, s.Close())
+	assert.Len(t, logsBatch(t, <-requests), 2)
+}
+
+func TestSpoutLogsEveryWebhook(t *testing.T) {
+	ts, requests := newFakeAPI(t)
+	defer ts.Close()
+
+	recorder := &recordingSink{name: "recorder"}
+	spout, err := spinnakerdatadog.NewSpout(nil, "testdata/routed-templates.yml",
+		spinnakerdatadog.WithSink(recorder),
+		spinnakerdatadog.WithLogs(spinnakerdatadog.NewLogsSink(ts.URL, "apikey")),
+	)
+	require.NoError(t, err)
+
+	d := spinnaker.NewDispatcher()
+	spout.AttachToDispatcher(d)
+
+	stageStarting := *pipelineComplete
+	stageStarting.Details.Type = "orca:stage:starting"
+	for _, incoming := range []*types.IncomingWebhook{pipelineComplete, &stageStarting} {
+		for result := range d.Dispatch(context.Background(), incoming) {
+			require.NoError(t, result.Err)
+		}
+	}
+	require.NoError(t, spout.Close())
+
+	batch := logsBatch(t, <-requests)
+	require.Len(t, batch, 2)
+	titles := []interface{}{batch[0]["title"], batch[1]["title"]}
+	assert.ElementsMatch(t, []interface{}{"someapp deployed", "orca:stage:starting for someapp"}, titles)
+	assert.Contains(t, batch[0]["ddtags"], "app:someapp")
+	assert.Len(t, recorder.events, 1, "only templated webhooks should be sent as events")
+}
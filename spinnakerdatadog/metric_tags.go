@@ -0,0 +1,158 @@
+package spinnakerdatadog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// OverflowTagValue replaces the value of a tag once a metric has seen more
+// distinct values for its key than the policy allows
+const OverflowTagValue = "other"
+
+// MetricTagRule restricts the tags sent with a single metric
+type MetricTagRule struct {
+	// Allow lists the only tag keys sent with the metric. When empty every
+	// key that isn't denied is sent
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists tag keys that are never sent with the metric
+	Deny []string `json:"deny,omitempty"`
+	// MaxValues caps how many distinct values are sent for a tag key. Values
+	// seen after the cap is reached are replaced with "other"
+	MaxValues map[string]int `json:"maxValues,omitempty"`
+}
+
+// MetricTagPolicy guards the cardinality of the metrics sent by the spout. It
+// holds a rule per metric name; the rule for "*" applies to every metric that
+// doesn't have its own. For example:
+//
+//	pipeline.duration:
+//	  deny: [triggered_by]
+//	  maxValues:
+//	    pipeline_name: 100
+type MetricTagPolicy struct {
+	rules map[string]*MetricTagRule
+
+	mu   sync.Mutex
+	seen map[string]map[string]map[string]bool
+	// overflow holds the values collapsed into "other" by metric and key, so
+	// each one is only reported once
+	overflow map[string]map[string]map[string]bool
+}
+
+// maxTrackedOverflow caps how many collapsed values are remembered per tag key
+// of a metric. Values collapsed beyond it are no longer reported
+const maxTrackedOverflow = 10000
+
+// NewMetricTagPolicy initializes a policy from the given rules keyed by metric name
+func NewMetricTagPolicy(rules map[string]*MetricTagRule) *MetricTagPolicy {
+	return &MetricTagPolicy{
+		rules:    rules,
+		seen:     make(map[string]map[string]map[string]bool),
+		overflow: make(map[string]map[string]map[string]bool),
+	}
+}
+
+// LoadMetricTagPolicy reads a metric tag policy from the given YAML file
+func LoadMetricTagPolicy(file string) (*MetricTagPolicy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read metric tag policy file")
+	}
+
+	rules := make(map[string]*MetricTagRule)
+	if err := yaml.Unmarshal(b, &rules); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal metric tag policy file")
+	}
+
+	return NewMetricTagPolicy(rules), nil
+}
+
+// Apply returns the tags that may be sent with the given metric, along with
+// the keys of the tags whose value was collapsed into "other" for the first
+// time. A value that was already collapsed isn't returned again, so every
+// distinct value dropped from the metric is only reported once
+func (p *MetricTagPolicy) Apply(metric string, tags []string) ([]string, []string) {
+	rule, ok := p.rules[metric]
+	if !ok {
+		rule, ok = p.rules["*"]
+	}
+	if !ok || rule == nil {
+		return tags, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var result, collapsed []string
+	for _, tag := range tags {
+		key := tagKey(tag)
+		if !rule.allows(key) {
+			continue
+		}
+
+		if max, ok := rule.MaxValues[key]; ok {
+			if kept, _ := remember(p.seen, metric, key, tag, max); !kept {
+				if _, added := remember(p.overflow, metric, key, tag, maxTrackedOverflow); added {
+					collapsed = append(collapsed, key)
+				}
+				tag = fmt.Sprintf("%s:%s", key, OverflowTagValue)
+			}
+		}
+
+		result = append(result, tag)
+	}
+
+	return removeDuplicateTags(result), collapsed
+}
+
+// remember records a value for the tag key of a metric in the given set. It
+// reports whether the value is within the cap of distinct values, and whether
+// it was added by this call. The caller must hold p.mu
+func remember(set map[string]map[string]map[string]bool, metric, key, tag string, max int) (bool, bool) {
+	keys, ok := set[metric]
+	if !ok {
+		keys = make(map[string]map[string]bool)
+		set[metric] = keys
+	}
+
+	values, ok := keys[key]
+	if !ok {
+		values = make(map[string]bool)
+		keys[key] = values
+	}
+
+	if values[tag] {
+		return true, false
+	}
+
+	if len(values) >= max {
+		return false, false
+	}
+
+	values[tag] = true
+	return true, true
+}
+
+func (r *MetricTagRule) allows(key string) bool {
+	for _, denied := range r.Deny {
+		if denied == key {
+			return false
+		}
+	}
+
+	if len(r.Allow) == 0 {
+		return true
+	}
+
+	for _, allowed := range r.Allow {
+		if allowed == key {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+package spinnakerdatadog_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+func TestLoadingMetricTagPolicy(t *testing.T) {
+	wd, _ := os.Getwd()
+
+	t.Run("Given a valid policy file", func(t *testing.T) {
+		_, err := spinnakerdatadog.LoadMetricTagPolicy(filepath.Join(wd, "testdata", "metric-tag-policy.yml"))
+		require.NoError(t, err)
+	})
+
+	t.Run("Given a missing policy file", func(t *testing.T) {
+		_, err := spinnakerdatadog.LoadMetricTagPolicy(filepath.Join(wd, "testdata", "nope.yml"))
+		require.Error(t, err)
+	})
+
+	t.Run("Given a badly formatted policy file", func(t *testing.T) {
+		_, err := spinnakerdatadog.LoadMetricTagPolicy(filepath.Join(wd, "testdata", "bad-format.yml"))
+		require.Error(t, err)
+	})
+}
+
+func TestApplyingMetricTagPolicy(t *testing.T) {
+	wd, _ := os.Getwd()
+	policy, err := spinnakerdatadog.LoadMetricTagPolicy(filepath.Join(wd, "testdata", "metric-tag-policy.yml"))
+	require.NoError(t, err)
+
+	t.Run("Denied tags are dropped", func(t *testing.T) {
+		tags, collapsed := policy.Apply("pipeline.duration", []string{"app:someapp", "triggered_by:someone"})
+		assert.Equal(t, []string{"app:someapp"}, tags)
+		assert.Empty(t, collapsed)
+	})
+
+	t.Run("Values over the cap are collapsed into other", func(t *testing.T) {
+		for _, name := range []string{"one", "two", "one"} {
+			tags, collapsed := policy.Apply("pipeline.duration", []string{"pipeline_name:" + name})
+			assert.Equal(t, []string{"pipeline_name:" + name}, tags)
+			assert.Empty(t, collapsed)
+		}
+
+		tags, collapsed := policy.Apply("pipeline.duration", []string{"pipeline_name:three"})
+		assert.Equal(t, []string{"pipeline_name:other"}, tags)
+		assert.Equal(t, []string{"pipeline_name"}, collapsed)
+
+		tags, collapsed = policy.Apply("pipeline.duration", []string{"pipeline_name:three"})
+		assert.Equal(t, []string{"pipeline_name:other"}, tags)
+		assert.Empty(t, collapsed, "values should only be reported the first time they are collapsed")
+	})
+
+	t.Run("Metrics without a rule use the wildcard rule", func(t *testing.T) {
+		tags, _ := policy.Apply("stage.duration", []string{"app:someapp", "status:complete"})
+		assert.Equal(t, []string{"app:someapp"}, tags)
+	})
+
+	t.Run("Metrics are left alone without a matching rule", func(t *testing.T) {
+		policy := spinnakerdatadog.NewMetricTagPolicy(nil)
+		tags, _ := policy.Apply("pipeline.duration", []string{"app:someapp", "status:complete"})
+		assert.Equal(t, []string{"app:someapp", "status:complete"}, tags)
+	})
+}
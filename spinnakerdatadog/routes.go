@@ -0,0 +1,137 @@
+package spinnakerdatadog
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// Route sends the webhooks it selects to another Datadog org. Application,
+// Pipeline and Account are glob patterns (see path.Match) matched against the
+// application, the pipeline name and the cloud account of the stage (the
+// account or credentials of its context), an empty pattern matches
+// everything. The keys of the org are read from a file or an environment
+// variable, and the site and event templates default to those of the bridge.
+type Route struct {
+	Name        string `json:"name"`
+	Application string `json:"application,omitempty"`
+	Pipeline    string `json:"pipeline,omitempty"`
+	Account     string `json:"account,omitempty"`
+
+	Site       string `json:"site,omitempty"`
+	APIURL     string `json:"apiUrl,omitempty"`
+	APIKeyFile string `json:"apiKeyFile,omitempty"`
+	APIKeyEnv  string `json:"apiKeyEnv,omitempty"`
+	AppKeyFile string `json:"appKeyFile,omitempty"`
+	AppKeyEnv  string `json:"appKeyEnv,omitempty"`
+
+	EventTemplates string `json:"eventTemplates,omitempty"`
+}
+
+// RoutesConfig lists the routes of the bridge, for example:
+//
+//	routes:
+//	  - name: payments
+//	    application: "pay*"
+//	    site: datadoghq.eu
+//	    apiKeyFile: /var/run/secrets/payments/datadog-api-key
+//	    eventTemplates: ./payments-templates.yml
+type RoutesConfig struct {
+	Routes []*Route `json:"routes"`
+}
+
+// LoadRoutes reads the routes from the given YAML file
+func LoadRoutes(file string) (*RoutesConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read routes file")
+	}
+
+	config := new(RoutesConfig)
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal routes file")
+	}
+
+	names := make(map[string]bool)
+	for _, route := range config.Routes {
+		if route.Name == "" {
+			return nil, errors.New("every route needs a name")
+		}
+		if names[route.Name] {
+			return nil, errors.Errorf("duplicate route %q", route.Name)
+		}
+		names[route.Name] = true
+
+		for _, pattern := range []string{route.Application, route.Pipeline, route.Account} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid pattern %q in route %q", pattern, route.Name)
+			}
+		}
+		if route.APIKeyFile == "" && route.APIKeyEnv == "" {
+			return nil, errors.Errorf("route %q needs an apiKeyFile or an apiKeyEnv", route.Name)
+		}
+	}
+
+	return config, nil
+}
+
+// Matches returns whether the route selects the given webhook
+func (r *Route) Matches(incoming *types.IncomingWebhook) bool {
+	account := incoming.Content.ContextString("account")
+	if account == "" {
+		account = incoming.Content.ContextString("credentials")
+	}
+
+	return spinnaker.MatchGlob(r.Application, incoming.Application()) &&
+		spinnaker.MatchGlob(r.Pipeline, incoming.Content.Execution.Name) &&
+		spinnaker.MatchGlob(r.Account, account)
+}
+
+// Credentials returns the keys of the route. Keys read from files are
+// re-read like any other credentials, configured with the given options
+func (r *Route) Credentials(opts ...CredentialsOption) (*Credentials, error) {
+	var apiKey, appKey string
+	if r.APIKeyFile != "" {
+		opts = append(opts, WithAPIKeyFile(r.APIKeyFile))
+	} else if r.APIKeyEnv != "" {
+		apiKey = os.Getenv(r.APIKeyEnv)
+		if apiKey == "" {
+			return nil, errors.Errorf("%s is empty", r.APIKeyEnv)
+		}
+	}
+
+	if r.AppKeyFile != "" {
+		opts = append(opts, WithAppKeyFile(r.AppKeyFile))
+	} else if r.AppKeyEnv != "" {
+		appKey = os.Getenv(r.AppKeyEnv)
+	}
+
+	c, err := NewCredentials(apiKey, appKey, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read keys of route %q", r.Name)
+	}
+
+	return c, nil
+}
+
+// filterHandler only runs the given handler for the webhooks accept returns
+// true for, keeping the phase of the handler. The handler is renamed to name
+// when it isn't empty
+func filterHandler(h spinnaker.Handler, name string, accept func(*types.IncomingWebhook) bool) spinnaker.Handler {
+	filtered := spinnaker.Filter(accept)(h)
+	if name != "" {
+		inner := spinnaker.AdaptHandler(filtered)
+		filtered = spinnaker.HandlerFunc(name, inner.HandleContext)
+	}
+	if ph, ok := h.(spinnaker.PhasedHandler); ok {
+		filtered = spinnaker.InPhase(ph.Phase(), filtered)
+	}
+
+	return filtered
+}
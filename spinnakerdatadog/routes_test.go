@@ -0,0 +1,164 @@
+package spinnakerdatadog_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	config, err := spinnakerdatadog.LoadRoutes("testdata/routes.yml")
+	require.NoError(t, err)
+	require.Len(t, config.Routes, 2)
+
+	payments, prod := config.Routes[0], config.Routes[1]
+	assert.Equal(t, "datadoghq.eu", payments.Site)
+	assert.Equal(t, "testdata/routed-templates.yml", payments.EventTemplates)
+
+	credentials, err := payments.Credentials()
+	require.NoError(t, err)
+	defer credentials.Close()
+	apiKey, appKey := credentials.Keys()
+	assert.Equal(t, "payments-key", apiKey)
+	assert.Empty(t, appKey)
+
+	_, err = prod.Credentials()
+	assert.Error(t, err, "the api key should be required")
+
+	os.Setenv("PROD_DATADOG_API_KEY", "prod-api-key")
+	defer os.Unsetenv("PROD_DATADOG_API_KEY")
+	os.Setenv("PROD_DATADOG_APP_KEY", "prod-app-key")
+	defer os.Unsetenv("PROD_DATADOG_APP_KEY")
+
+	credentials, err = prod.Credentials()
+	require.NoError(t, err)
+	apiKey, appKey = credentials.Keys()
+	assert.Equal(t, "prod-api-key", apiKey)
+	assert.Equal(t, "prod-app-key", appKey)
+}
+
+func TestLoadRoutesRejectsInvalidRoutes(t *testing.T) {
+	for name, routes := range map[string]string{
+		"missing name":    "routes:\n  - apiKeyEnv: KEY\n",
+		"duplicate name":  "routes:\n  - name: a\n    apiKeyEnv: KEY\n  - name: a\n    apiKeyEnv: KEY\n",
+		"invalid pattern": "routes:\n  - name: a\n    application: \"[\"\n    apiKeyEnv: KEY\n",
+		"missing api key": "routes:\n  - name: a\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "routes")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			_, err = f.WriteString(routes)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			_, err = spinnakerdatadog.LoadRoutes(f.Name())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	route := &spinnakerdatadog.Route{Application: "pay*", Pipeline: "Deploy*", Account: "prod-*"}
+
+	incoming := &types.IncomingWebhook{
+		Details: types.Details{Application: "payments"},
+		Content: types.Content{
+			Execution: types.Execution{Name: "Deploy to prod"},
+			Context:   map[string]interface{}{"credentials": "prod-eu"},
+		},
+	}
+	assert.True(t, route.Matches(incoming))
+
+	incoming.Content.Context = map[string]interface{}{"account": "staging"}
+	assert.False(t, route.Matches(incoming))
+}
+
+func TestSpoutRoutesWebhooks(t *testing.T) {
+	config, err := spinnakerdatadog.LoadRoutes("testdata/routes.yml")
+	require.NoError(t, err)
+
+	routed := &recordingSink{name: "recorder"}
+	routeSpout, err := spinnakerdatadog.NewSpout(nil, "testdata/routed-templates.yml", spinnakerdatadog.WithSink(routed))
+	require.NoError(t, err)
+
+	unrouted := &recordingSink{name: "recorder"}
+	spout, err := spinnakerdatadog.NewSpout(nil, "testdata/routed-templates.yml",
+		spinnakerdatadog.WithSink(unrouted),
+		spinnakerdatadog.WithRoute(config.Routes[0], routeSpout),
+	)
+	require.NoError(t, err)
+	require.NoError(t, spout.CompileTemplates())
+
+	d := spinnaker.NewDispatcher()
+	spout.AttachToDispatcher(d)
+
+	handled := map[string]bool{}
+	for _, app := range []string{"payments", "someapp"} {
+		incoming := *pipelineComplete
+		incoming.Details.Application = app
+		for result := range d.Dispatch(context.Background(), &incoming) {
+			require.NoError(t, result.Err)
+			handled[result.HandlerName] = true
+		}
+	}
+	assert.Contains(t, handled, "DatadogEventHandler")
+	assert.Contains(t, handled, "DatadogEventHandler@"+config.Routes[0].Name)
+
+	require.Len(t, routed.events, 1)
+	assert.Equal(t, "payments deployed", routed.events[0].Title)
+	require.Len(t, unrouted.events, 1)
+	assert.Equal(t, "someapp deployed", unrouted.events[0].Title)
+}
+
+func TestSpoutRoutesDORAMetrics(t *testing.T) {
+	config, err := spinnakerdatadog.LoadRoutes("testdata/routes.yml")
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "dora")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("deployments:\n  - application: \"*\"\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	dora, err := spinnakerdatadog.LoadDORAConfig(f.Name())
+	require.NoError(t, err)
+
+	routedAPI, routed := newFakeAPI(t)
+	defer routedAPI.Close()
+	routeSpout, err := spinnakerdatadog.NewSpout(nil, "", spinnakerdatadog.WithDORA(spinnakerdatadog.NewDORAHandler(routedAPI.URL, "apikey", dora)))
+	require.NoError(t, err)
+
+	unroutedAPI, unrouted := newFakeAPI(t)
+	defer unroutedAPI.Close()
+	spout, err := spinnakerdatadog.NewSpout(nil, "",
+		spinnakerdatadog.WithDORA(spinnakerdatadog.NewDORAHandler(unroutedAPI.URL, "apikey", dora)),
+		spinnakerdatadog.WithRoute(config.Routes[0], routeSpout),
+	)
+	require.NoError(t, err)
+
+	d := spinnaker.NewDispatcher()
+	spout.AttachToDispatcher(d)
+
+	handled := map[string]bool{}
+	for _, app := range []string{"payments", "someapp"} {
+		for result := range d.Dispatch(context.Background(), deployWebhook("orca:pipeline:complete", app, "Deploy")) {
+			require.NoError(t, result.Err)
+			handled[result.HandlerName] = true
+		}
+	}
+	assert.Equal(t, map[string]bool{"DORAHandler": true, "DORAHandler@" + config.Routes[0].Name: true}, handled)
+
+	assert.Equal(t, "payments", decodeDORARecord(t, <-routed).attributes["service"])
+	assert.Equal(t, "someapp", decodeDORARecord(t, <-unrouted).attributes["service"])
+	assert.Empty(t, routed)
+	assert.Empty(t, unrouted)
+}
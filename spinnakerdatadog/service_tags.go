@@ -0,0 +1,118 @@
+package spinnakerdatadog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+)
+
+// ServiceTags maps fields of a webhook onto Datadog's unified service tags
+// (service, env and version). Each field is a text/template rendered with the
+// incoming webhook, so values aren't HTML escaped, for example:
+//
+//	service: "{{ .Details.Application }}"
+//	env: "{{ .Content.ContextString \"account\" }}"
+//	version: "{{ .Content.Execution.Trigger.Tag }}"
+type ServiceTags struct {
+	Service string `json:"service,omitempty"`
+	Env     string `json:"env,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	compiled   map[string]*template.Template
+	isCompiled bool
+	mu         sync.Mutex
+}
+
+// LoadServiceTags reads a service tag mapping from the given YAML file
+func LoadServiceTags(file string) (*ServiceTags, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read service tags file")
+	}
+
+	st := new(ServiceTags)
+	if err := yaml.Unmarshal(b, st); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal service tags file")
+	}
+
+	if err := st.Compile(); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Compile parses the templates of the mapping. It is safe to call
+// concurrently and only parses the templates once
+func (st *ServiceTags) Compile() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.isCompiled {
+		return nil
+	}
+
+	st.compiled = make(map[string]*template.Template)
+	for key, text := range map[string]string{"service": st.Service, "env": st.Env, "version": st.Version} {
+		if text == "" {
+			continue
+		}
+
+		compiled, err := template.New(key).Parse(text)
+		if err != nil {
+			return errors.Wrapf(err, "could not compile %s tag", key)
+		}
+		st.compiled[key] = compiled
+	}
+
+	st.isCompiled = true
+	return nil
+}
+
+// Tags renders the service, env and version tags for the given webhook. Tags
+// that render to an empty value are left out
+func (st *ServiceTags) Tags(incoming *types.IncomingWebhook) ([]string, error) {
+	values, err := st.Values(incoming)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, key := range []string{"service", "env", "version"} {
+		if value := values[key]; value != "" {
+			tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+		}
+	}
+
+	return tags, nil
+}
+
+// Values renders the service, env and version for the given webhook, keyed by
+// tag name. Values that render empty are left out
+func (st *ServiceTags) Values(incoming *types.IncomingWebhook) (map[string]string, error) {
+	if err := st.Compile(); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for key, compiled := range st.compiled {
+		buf := new(bytes.Buffer)
+		if err := compiled.Execute(buf, incoming); err != nil {
+			return nil, errors.Wrapf(err, "could not render %s tag", key)
+		}
+
+		if value := strings.TrimSpace(buf.String()); value != "" {
+			values[key] = value
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,90 @@
+package spinnakerdatadog_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+func TestLoadingServiceTags(t *testing.T) {
+	wd, _ := os.Getwd()
+
+	t.Run("Given a valid mapping file", func(t *testing.T) {
+		st, err := spinnakerdatadog.LoadServiceTags(filepath.Join(wd, "testdata", "service-tags.yml"))
+		require.NoError(t, err)
+		assert.Equal(t, "{{ .Details.Application }}", st.Service)
+	})
+
+	t.Run("Given a missing mapping file", func(t *testing.T) {
+		_, err := spinnakerdatadog.LoadServiceTags(filepath.Join(wd, "testdata", "nope.yml"))
+		require.Error(t, err)
+	})
+
+	t.Run("Given a badly formatted mapping file", func(t *testing.T) {
+		_, err := spinnakerdatadog.LoadServiceTags(filepath.Join(wd, "testdata", "bad-format.yml"))
+		require.Error(t, err)
+	})
+}
+
+func TestRenderingServiceTags(t *testing.T) {
+	wd, _ := os.Getwd()
+	st, err := spinnakerdatadog.LoadServiceTags(filepath.Join(wd, "testdata", "service-tags.yml"))
+	require.NoError(t, err)
+
+	t.Run("Given a docker triggered deploy stage", func(t *testing.T) {
+		tags, err := st.Tags(&types.IncomingWebhook{
+			Details: types.Details{Application: "someapp"},
+			Content: types.Content{
+				Context: map[string]interface{}{"account": "production"},
+				Execution: types.Execution{
+					Trigger: types.Trigger{Type: "docker", Tag: "v1.2.3"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"service:someapp", "env:production", "version:v1.2.3"}, tags)
+	})
+
+	t.Run("Given an artifact triggered pipeline without an account", func(t *testing.T) {
+		tags, err := st.Tags(&types.IncomingWebhook{
+			Details: types.Details{Application: "someapp"},
+			Content: types.Content{
+				Execution: types.Execution{
+					Trigger: types.Trigger{Artifacts: []types.Artifact{{Name: "someapp"}, {Name: "someapp", Version: "42"}}},
+				},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"service:someapp", "version:42"}, tags)
+	})
+
+	t.Run("Given a template that can't be rendered", func(t *testing.T) {
+		st := &spinnakerdatadog.ServiceTags{Service: "{{ .Details.Bad }}"}
+		_, err := st.Tags(&types.IncomingWebhook{})
+		require.Error(t, err)
+	})
+}
+
+func TestRenderingServiceTagsConcurrently(t *testing.T) {
+	st := &spinnakerdatadog.ServiceTags{Service: "{{ .Details.Application }}"}
+	incoming := &types.IncomingWebhook{Details: types.Details{Application: "hcm"}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tags, err := st.Tags(incoming)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"service:hcm"}, tags)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,93 @@
+package spinnakerdatadog
+
+import (
+	"context"
+
+	dogstatsd "github.com/DataDog/datadog-go/statsd"
+	"github.com/pkg/errors"
+	datadog "gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+// DatadogSinkName is the name templates use to send to the Datadog sink
+const DatadogSinkName = "datadog"
+
+// DatadogSink sends events to the Datadog API and metrics and service checks
+// to DogStatsD. Metric and service check names are prefixed with "spinnaker."
+type DatadogSink struct {
+	events apiClient
+	statsd *dogstatsd.Client
+}
+
+var _ sink.Sink = (*DatadogSink)(nil)
+
+// NewDatadogSink initializes a sink that sends with the given clients. Events
+// are posted to the base URL of c with its HTTP client, which must add the keys
+// to requests as Credentials.Client does. The result of every call to the
+// Datadog API is recorded with the given recorder
+func NewDatadogSink(c *datadog.Client, statsd *dogstatsd.Client, r telemetry.Recorder) *DatadogSink {
+	var baseURL string
+	if c != nil {
+		baseURL = c.GetBaseUrl()
+	}
+	events := newAPIClient("datadog api", baseURL, DefaultAPIURL, "")
+	if c != nil && c.HttpClient != nil {
+		events.client = c.HttpClient
+	}
+	if r != nil {
+		events.recorder = r
+	}
+
+	return &DatadogSink{events: events, statsd: statsd}
+}
+
+// Name implements sink.Sink
+func (ds *DatadogSink) Name() string {
+	return DatadogSinkName
+}
+
+// SendEvent implements sink.Sink. The call is cancelled once ctx is done
+func (ds *DatadogSink) SendEvent(ctx context.Context, e *sink.Event) error {
+	event := &datadog.Event{Tags: e.Tags}
+	event.SetTitle(e.Title)
+	event.SetText(e.Text)
+	event.SetAggregation(e.AggregationKey)
+	if e.AlertType != "" {
+		event.SetAlertType(e.AlertType)
+	}
+	if !e.Timestamp.IsZero() {
+		event.SetTime(int(e.Timestamp.Unix()))
+	}
+
+	return errors.Wrap(ds.events.postJSON(ctx, "/api/v1/events", "events", event), "could not post to datadog API")
+}
+
+// SendMetric implements sink.Sink
+func (ds *DatadogSink) SendMetric(ctx context.Context, m *sink.Metric) error {
+	name := statsdNamespace + m.Name
+
+	var err error
+	switch m.Type {
+	case sink.Gauge:
+		err = ds.statsd.Gauge(name, m.Value, m.Tags, 1)
+	case sink.Count:
+		err = ds.statsd.Count(name, int64(m.Value), m.Tags, 1)
+	case sink.Timing:
+		err = ds.statsd.TimeInMilliseconds(name, m.Value, m.Tags, 1)
+	default:
+		return errors.Errorf("unknown metric type %q", m.Type)
+	}
+
+	return errors.Wrap(err, "could not submit metric to dogstatsd")
+}
+
+// SendServiceCheck implements sink.Sink
+func (ds *DatadogSink) SendServiceCheck(ctx context.Context, c *sink.ServiceCheck) error {
+	check := dogstatsd.NewServiceCheck(statsdNamespace+c.Name, dogstatsd.ServiceCheckStatus(c.Status))
+	check.Message = c.Message
+	check.Tags = c.Tags
+
+	return errors.Wrap(ds.statsd.ServiceCheck(check), "could not submit service check to dogstatsd")
+}
@@ -0,0 +1,152 @@
+package spinnakerdatadog_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	datadog "gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/sink"
+	"github.com/DataDog/spinnaker-datadog-bridge/spinnaker/types"
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+type recordingSink struct {
+	name string
+
+	mu      sync.Mutex
+	events  []*sink.Event
+	metrics []*sink.Metric
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) SendEvent(ctx context.Context, event *sink.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingSink) SendMetric(ctx context.Context, metric *sink.Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics = append(s.metrics, metric)
+	return nil
+}
+
+func (s *recordingSink) SendServiceCheck(ctx context.Context, check *sink.ServiceCheck) error {
+	return nil
+}
+
+var pipelineComplete = &types.IncomingWebhook{
+	Details: types.Details{
+		Application: "someapp",
+		Type:        "orca:pipeline:complete",
+	},
+	Content: types.Content{
+		ExecutionID: "someid",
+		Execution: types.Execution{
+			Name:      "deploy",
+			StartTime: types.Timestamp{Time: time.Unix(100, 0)},
+			EndTime:   types.Timestamp{Time: time.Unix(160, 0)},
+		},
+	},
+}
+
+func TestSpoutSendsToTemplateSinks(t *testing.T) {
+	t.Run("Given a template that lists its sinks", func(t *testing.T) {
+		other := &recordingSink{name: "other"}
+		spout, err := spinnakerdatadog.NewSpout(nil, "", spinnakerdatadog.WithSink(other))
+		require.NoError(t, err)
+
+		handler := spinnakerdatadog.NewDatadogEventHandler(spout, &spinnakerdatadog.EventTemplate{
+			Title: "{{ .Details.Application }} deployed",
+			Sinks: []string{"other"},
+		})
+		require.NoError(t, handler.Handle(pipelineComplete))
+
+		require.Len(t, other.events, 1)
+		assert.Equal(t, "someapp deployed", other.events[0].Title)
+		assert.Equal(t, "someid", other.events[0].AggregationKey)
+		assert.Equal(t, pipelineComplete, other.events[0].Webhook)
+
+		require.Len(t, other.metrics, 1)
+		assert.Equal(t, "pipeline.duration", other.metrics[0].Name)
+		assert.Equal(t, sink.Timing, other.metrics[0].Type)
+		assert.Equal(t, float64(60000), other.metrics[0].Value)
+	})
+
+	t.Run("Given a template that doesn't list its sinks", func(t *testing.T) {
+		done := make(chan error, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			var event datadog.Event
+			done <- json.NewDecoder(req.Body).Decode(&event)
+		}))
+		defer ts.Close()
+		os.Setenv("DATADOG_HOST", ts.URL)
+		defer os.Unsetenv("DATADOG_HOST")
+
+		other := &recordingSink{name: "other"}
+		spout, err := spinnakerdatadog.NewSpout(datadog.NewClient("", ""), "", spinnakerdatadog.WithSink(other))
+		require.NoError(t, err)
+
+		handler := spinnakerdatadog.NewDatadogEventHandler(spout, &spinnakerdatadog.EventTemplate{
+			Title: "{{ .Details.Application }} deployed",
+		})
+		require.NoError(t, handler.Handle(pipelineComplete))
+
+		assert.Len(t, other.events, 1)
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Millisecond * 100):
+			t.Error("event was never sent to datadog")
+		}
+	})
+
+	t.Run("Given a template with an unknown sink", func(t *testing.T) {
+		spout, err := spinnakerdatadog.NewSpout(nil, "")
+		require.NoError(t, err)
+
+		handler := spinnakerdatadog.NewDatadogEventHandler(spout, &spinnakerdatadog.EventTemplate{
+			Title: "{{ .Details.Application }} deployed",
+			Sinks: []string{"nope"},
+		})
+		assert.Error(t, handler.Handle(pipelineComplete))
+	})
+}
+
+func TestDatadogSinkCancelsEvents(t *testing.T) {
+	cancelled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		// The server only notices the client going away once the body is read
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+		close(cancelled)
+	}))
+	defer ts.Close()
+
+	client := datadog.NewClient("", "")
+	client.SetBaseUrl(ts.URL)
+	ds := spinnakerdatadog.NewDatadogSink(client, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.Error(t, ds.SendEvent(ctx, &sink.Event{Title: "deployed"}))
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("call to the events API was never cancelled")
+	}
+}
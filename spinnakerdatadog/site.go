@@ -0,0 +1,87 @@
+package spinnakerdatadog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSite is the Datadog site (US1) the bridge sends to unless told otherwise
+const DefaultSite = "datadoghq.com"
+
+// DefaultAPIURL is the base URL of the Datadog API of the default site
+const DefaultAPIURL = "https://api." + DefaultSite
+
+// DefaultLogsURL is the base URL of the Datadog logs HTTP intake of the
+// default site
+const DefaultLogsURL = "https://http-intake.logs." + DefaultSite
+
+// APIURL returns the base URL of the Datadog API of the given site, such as
+// datadoghq.eu or us5.datadoghq.com
+func APIURL(site string) string {
+	if site == "" {
+		site = DefaultSite
+	}
+
+	return "https://api." + site
+}
+
+// LogsURL returns the base URL of the Datadog logs HTTP intake of the given site
+func LogsURL(site string) string {
+	if site == "" {
+		site = DefaultSite
+	}
+
+	return "https://http-intake.logs." + site
+}
+
+// NewHTTPClient builds the client used to reach Datadog. Requests go through
+// the proxy at proxyURL when it is set, and through the proxy configured by
+// the HTTPS_PROXY and NO_PROXY environment variables otherwise. When caBundle
+// is set, the certificates in that PEM file are trusted along with the
+// system's
+func NewHTTPClient(proxyURL, caBundle string) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse proxy url")
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	if caBundle != "" {
+		b, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read ca bundle")
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificates found in ca bundle %s", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, nil
+}
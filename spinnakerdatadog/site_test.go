@@ -0,0 +1,71 @@
+package spinnakerdatadog_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+func TestSiteURLs(t *testing.T) {
+	assert.Equal(t, spinnakerdatadog.DefaultAPIURL, spinnakerdatadog.APIURL(""))
+	assert.Equal(t, "https://api.datadoghq.eu", spinnakerdatadog.APIURL("datadoghq.eu"))
+	assert.Equal(t, spinnakerdatadog.DefaultLogsURL, spinnakerdatadog.LogsURL(""))
+	assert.Equal(t, "https://http-intake.logs.us5.datadoghq.com", spinnakerdatadog.LogsURL("us5.datadoghq.com"))
+}
+
+func TestHTTPClientUsesProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied <- req.URL.String()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer proxy.Close()
+
+	client, err := spinnakerdatadog.NewHTTPClient(proxy.URL, "")
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://api.datadoghq.invalid/api/v1/validate")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "http://api.datadoghq.invalid/api/v1/validate", <-proxied)
+}
+
+func TestHTTPClientTrustsCABundle(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	client, err := spinnakerdatadog.NewHTTPClient("", "")
+	require.NoError(t, err)
+	_, err = client.Get(ts.URL)
+	assert.Error(t, err, "the certificate of the test server should not be trusted by default")
+
+	f, err := ioutil.TempFile("", "ca-bundle")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+	require.NoError(t, f.Close())
+
+	client, err = spinnakerdatadog.NewHTTPClient("", f.Name())
+	require.NoError(t, err)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestHTTPClientRejectsInvalidCABundle(t *testing.T) {
+	_, err := spinnakerdatadog.NewHTTPClient("", "testdata/dora.yml")
+	assert.Error(t, err)
+
+	_, err = spinnakerdatadog.NewHTTPClient("", "testdata/missing.pem")
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package spinnakerdatadog
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxTagLength is the maximum length of a tag accepted by Datadog
+const maxTagLength = 200
+
+// TagNormalizer rewrites tags so they follow Datadog's tag rules. Tags are
+// lowercased, characters that aren't allowed are replaced with underscores,
+// they're truncated to 200 characters and tags with an empty value
+// ("triggered_by:") are dropped. See https://docs.datadoghq.com/tagging/#defining-tags
+type TagNormalizer struct {
+	allowedKeys map[string]bool
+}
+
+// NewTagNormalizer initializes a tag normalizer. When allowedKeys is not empty
+// every tag whose key isn't in it is dropped
+func NewTagNormalizer(allowedKeys []string) *TagNormalizer {
+	n := &TagNormalizer{}
+	if len(allowedKeys) > 0 {
+		n.allowedKeys = make(map[string]bool, len(allowedKeys))
+		for _, key := range allowedKeys {
+			n.allowedKeys[normalizeTag(key)] = true
+		}
+	}
+
+	return n
+}
+
+// Normalize returns the normalized version of the given tags. Anything that
+// had to be altered or dropped is logged at the debug level
+func (n *TagNormalizer) Normalize(tags []string) []string {
+	result := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		normalized := normalizeTag(tag)
+		key := tagKey(normalized)
+
+		var reason string
+		switch {
+		case normalized == "":
+			reason = "empty tag"
+		case strings.HasSuffix(normalized, ":"):
+			reason = "empty value"
+		case n.allowedKeys != nil && !n.allowedKeys[key]:
+			reason = "key not allowed"
+		}
+
+		if reason != "" {
+			logrus.WithFields(logrus.Fields{
+				"tag":    tag,
+				"reason": reason,
+			}).Debug("dropped tag")
+			continue
+		}
+
+		if normalized != tag {
+			logrus.WithFields(logrus.Fields{
+				"tag":        tag,
+				"normalized": normalized,
+			}).Debug("normalized tag")
+		}
+
+		result = append(result, normalized)
+	}
+
+	return removeDuplicateTags(result)
+}
+
+// tagKey returns the key of a "key:value" tag, or the whole tag if it has no value
+func tagKey(tag string) string {
+	if i := strings.Index(tag, ":"); i >= 0 {
+		return tag[:i]
+	}
+
+	return tag
+}
+
+// normalizeTag applies Datadog's tag rules to a single tag
+func normalizeTag(tag string) string {
+	var b strings.Builder
+	length := 0
+	lastUnderscore := false
+
+	for _, r := range strings.ToLower(tag) {
+		if length >= maxTagLength {
+			break
+		}
+
+		switch {
+		case unicode.IsLetter(r):
+		case b.Len() == 0:
+			// Tags must start with a letter
+			continue
+		case unicode.IsDigit(r), r == '-', r == ':', r == '.', r == '/':
+		default:
+			r = '_'
+		}
+
+		if r == '_' {
+			if lastUnderscore {
+				continue
+			}
+			lastUnderscore = true
+		} else {
+			lastUnderscore = false
+		}
+
+		b.WriteRune(r)
+		length++
+	}
+
+	return strings.TrimRight(b.String(), "_")
+}
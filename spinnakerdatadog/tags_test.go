@@ -0,0 +1,68 @@
+package spinnakerdatadog_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	spinnakerdatadog "github.com/DataDog/spinnaker-datadog-bridge/spinnakerdatadog"
+)
+
+func TestNormalizingTags(t *testing.T) {
+	tests := []struct {
+		scenario    string
+		allowedKeys []string
+		tags        []string
+		expected    []string
+	}{
+		{
+			scenario: "Valid tags are left alone",
+			tags:     []string{"app:someapp", "orca:stage:complete", "env:prod-us/east.1"},
+			expected: []string{"app:someapp", "orca:stage:complete", "env:prod-us/east.1"},
+		},
+		{
+			scenario: "Tags are lowercased",
+			tags:     []string{"pipelineConfigId:ABC"},
+			expected: []string{"pipelineconfigid:abc"},
+		},
+		{
+			scenario: "Characters that aren't allowed are replaced with a single underscore",
+			tags:     []string{"pipeline_name:Deploy to  Prod!", "triggered_by:user@email.com"},
+			expected: []string{"pipeline_name:deploy_to_prod", "triggered_by:user_email.com"},
+		},
+		{
+			scenario: "Tags must start with a letter",
+			tags:     []string{"_9lives:yes"},
+			expected: []string{"lives:yes"},
+		},
+		{
+			scenario: "Tags with empty values are dropped",
+			tags:     []string{"triggered_by:", "status:???", "", "app:someapp"},
+			expected: []string{"app:someapp"},
+		},
+		{
+			scenario: "Tags that become duplicates are only sent once",
+			tags:     []string{"env:Prod", "env:prod"},
+			expected: []string{"env:prod"},
+		},
+		{
+			scenario: "Long tags are truncated to 200 characters",
+			tags:     []string{"pipeline_name:" + strings.Repeat("a", 300)},
+			expected: []string{"pipeline_name:" + strings.Repeat("a", 200-len("pipeline_name:"))},
+		},
+		{
+			scenario:    "Tags with keys that aren't allowed are dropped",
+			allowedKeys: []string{"app", "Env"},
+			tags:        []string{"app:someapp", "env:prod", "triggered_by:someone", "standalone"},
+			expected:    []string{"app:someapp", "env:prod"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			n := spinnakerdatadog.NewTagNormalizer(test.allowedKeys)
+			assert.Equal(t, test.expected, n.Normalize(test.tags))
+		})
+	}
+}
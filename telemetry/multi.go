@@ -0,0 +1,85 @@
+package telemetry
+
+import "time"
+
+// Multi is a recorder that passes every measurement on to all of its recorders
+type Multi []Recorder
+
+var _ Recorder = Multi(nil)
+
+// RequestHandled implements Recorder
+func (m Multi) RequestHandled(path string, code int, d time.Duration) {
+	for _, r := range m {
+		r.RequestHandled(path, code, d)
+	}
+}
+
+// WebhookDecodeFailed implements Recorder
+func (m Multi) WebhookDecodeFailed() {
+	for _, r := range m {
+		r.WebhookDecodeFailed()
+	}
+}
+
+// WebhookTimedOut implements Recorder
+func (m Multi) WebhookTimedOut() {
+	for _, r := range m {
+		r.WebhookTimedOut()
+	}
+}
+
+// WebhookDispatched implements Recorder
+func (m Multi) WebhookDispatched(hookType string, handlers int) {
+	for _, r := range m {
+		r.WebhookDispatched(hookType, handlers)
+	}
+}
+
+// WebhookDuplicate implements Recorder
+func (m Multi) WebhookDuplicate(hookType string) {
+	for _, r := range m {
+		r.WebhookDuplicate(hookType)
+	}
+}
+
+// HandlerCompleted implements Recorder
+func (m Multi) HandlerCompleted(hookType, handler string, d time.Duration, err error) {
+	for _, r := range m {
+		r.HandlerCompleted(hookType, handler, d, err)
+	}
+}
+
+// HandlerPanicked implements Recorder
+func (m Multi) HandlerPanicked(hookType, handler string) {
+	for _, r := range m {
+		r.HandlerPanicked(hookType, handler)
+	}
+}
+
+// HandlerAbandoned implements Recorder
+func (m Multi) HandlerAbandoned(hookType, handler string) {
+	for _, r := range m {
+		r.HandlerAbandoned(hookType, handler)
+	}
+}
+
+// MetricTagsCollapsed implements Recorder
+func (m Multi) MetricTagsCollapsed(metric, tagKey string) {
+	for _, r := range m {
+		r.MetricTagsCollapsed(metric, tagKey)
+	}
+}
+
+// DatadogAPICall implements Recorder
+func (m Multi) DatadogAPICall(endpoint string, d time.Duration, err error) {
+	for _, r := range m {
+		r.DatadogAPICall(endpoint, d, err)
+	}
+}
+
+// HandlersInFlight implements Recorder
+func (m Multi) HandlersInFlight(n int) {
+	for _, r := range m {
+		r.HandlersInFlight(n)
+	}
+}
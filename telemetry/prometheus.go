@@ -0,0 +1,270 @@
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the buckets of every
+// duration histogram
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Prometheus is a recorder that keeps counters and histograms in memory and
+// serves them in the Prometheus text exposition format. It implements
+// http.Handler so it can be mounted at /metrics.
+type Prometheus struct {
+	requests        *family
+	requestDuration *family
+	decodeFailures  *family
+	timeouts        *family
+	dispatches      *family
+	duplicates      *family
+	handlerResults  *family
+	handlerDuration *family
+	handlerPanics   *family
+	handlerAbandons *family
+	tagCollapses    *family
+	apiCalls        *family
+	apiDuration     *family
+	inFlight        *family
+
+	families []*family
+}
+
+var (
+	_ Recorder     = (*Prometheus)(nil)
+	_ http.Handler = (*Prometheus)(nil)
+)
+
+// NewPrometheus initializes a Prometheus recorder with all of the bridge metrics
+func NewPrometheus() *Prometheus {
+	p := &Prometheus{}
+	p.requests = p.counter("spinnaker_bridge_http_requests_total", "HTTP requests answered by the server.", "path", "code")
+	p.requestDuration = p.histogram("spinnaker_bridge_http_request_duration_seconds", "Time taken to answer HTTP requests.", "path")
+	p.decodeFailures = p.counter("spinnaker_bridge_webhook_decode_failures_total", "Webhooks whose body could not be decoded.")
+	p.timeouts = p.counter("spinnaker_bridge_webhook_timeouts_total", "Webhooks whose handlers did not finish in time.")
+	p.dispatches = p.counter("spinnaker_bridge_dispatches_total", "Webhooks dispatched to handlers.", "hook_type")
+	p.duplicates = p.counter("spinnaker_bridge_webhook_duplicates_total", "Webhooks dropped because they were already dispatched.", "hook_type")
+	p.handlerResults = p.counter("spinnaker_bridge_handler_results_total", "Handler executions by outcome.", "hook_type", "handler", "outcome")
+	p.handlerDuration = p.histogram("spinnaker_bridge_handler_duration_seconds", "Time taken by handlers.", "hook_type", "handler")
+	p.handlerPanics = p.counter("spinnaker_bridge_handler_panics_total", "Handler executions that panicked.", "hook_type", "handler")
+	p.handlerAbandons = p.counter("spinnaker_bridge_handlers_abandoned_total", "Handlers that returned while work they started was still running.", "hook_type", "handler")
+	p.tagCollapses = p.counter("spinnaker_bridge_metric_tags_collapsed_total", "Distinct tag values collapsed into other by the metric tag policy.", "metric", "tag_key")
+	p.apiCalls = p.counter("spinnaker_bridge_datadog_api_calls_total", "Calls to the Datadog API by outcome.", "endpoint", "outcome")
+	p.apiDuration = p.histogram("spinnaker_bridge_datadog_api_duration_seconds", "Time taken by calls to the Datadog API.", "endpoint")
+	p.inFlight = p.gauge("spinnaker_bridge_handlers_in_flight", "Handlers currently running.")
+
+	return p
+}
+
+// RequestHandled implements Recorder
+func (p *Prometheus) RequestHandled(path string, code int, d time.Duration) {
+	p.requests.add(1, path, strconv.Itoa(code))
+	p.requestDuration.observe(d.Seconds(), path)
+}
+
+// WebhookDecodeFailed implements Recorder
+func (p *Prometheus) WebhookDecodeFailed() {
+	p.decodeFailures.add(1)
+}
+
+// WebhookTimedOut implements Recorder
+func (p *Prometheus) WebhookTimedOut() {
+	p.timeouts.add(1)
+}
+
+// WebhookDispatched implements Recorder
+func (p *Prometheus) WebhookDispatched(hookType string, handlers int) {
+	p.dispatches.add(1, hookTypeLabel(hookType))
+}
+
+// WebhookDuplicate implements Recorder
+func (p *Prometheus) WebhookDuplicate(hookType string) {
+	p.duplicates.add(1, hookTypeLabel(hookType))
+}
+
+// HandlerCompleted implements Recorder
+func (p *Prometheus) HandlerCompleted(hookType, handler string, d time.Duration, err error) {
+	p.handlerResults.add(1, hookTypeLabel(hookType), handler, outcome(err))
+	p.handlerDuration.observe(d.Seconds(), hookTypeLabel(hookType), handler)
+}
+
+// HandlerPanicked implements Recorder
+func (p *Prometheus) HandlerPanicked(hookType, handler string) {
+	p.handlerPanics.add(1, hookTypeLabel(hookType), handler)
+}
+
+// HandlerAbandoned implements Recorder
+func (p *Prometheus) HandlerAbandoned(hookType, handler string) {
+	p.handlerAbandons.add(1, hookTypeLabel(hookType), handler)
+}
+
+// MetricTagsCollapsed implements Recorder
+func (p *Prometheus) MetricTagsCollapsed(metric, tagKey string) {
+	p.tagCollapses.add(1, metric, tagKey)
+}
+
+// DatadogAPICall implements Recorder
+func (p *Prometheus) DatadogAPICall(endpoint string, d time.Duration, err error) {
+	p.apiCalls.add(1, endpoint, outcome(err))
+	p.apiDuration.observe(d.Seconds(), endpoint)
+}
+
+// HandlersInFlight implements Recorder
+func (p *Prometheus) HandlersInFlight(n int) {
+	p.inFlight.set(float64(n))
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	buf := bufio.NewWriter(w)
+	for _, f := range p.families {
+		f.write(buf)
+	}
+	buf.Flush()
+}
+
+func (p *Prometheus) counter(name, help string, labels ...string) *family {
+	f := &family{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*series)}
+	p.families = append(p.families, f)
+
+	// Metrics without labels are exported as zero before anything is recorded
+	if len(labels) == 0 {
+		f.get(nil)
+	}
+
+	return f
+}
+
+func (p *Prometheus) gauge(name, help string, labels ...string) *family {
+	f := p.counter(name, help, labels...)
+	f.kind = "gauge"
+	return f
+}
+
+func (p *Prometheus) histogram(name, help string, labels ...string) *family {
+	f := &family{name: name, help: help, kind: "histogram", labels: labels, buckets: DefaultBuckets, series: make(map[string]*series)}
+	p.families = append(p.families, f)
+	return f
+}
+
+// family is a metric and all of its series (one per set of label values)
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+// get returns the series for the given label values, creating it if needed.
+// The caller must hold f.mu
+func (f *family) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func (f *family) add(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.get(labelValues).value += v
+}
+
+func (f *family) set(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.get(labelValues).value = v
+}
+
+func (f *family) observe(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.get(labelValues)
+	s.value += v
+	s.count++
+	for i, upper := range f.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		labels := formatLabels(f.labels, s.labelValues)
+
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatValue(s.value))
+			continue
+		}
+
+		names := append(append([]string(nil), f.labels...), "le")
+		for i, upper := range f.buckets {
+			le := formatLabels(names, append(append([]string(nil), s.labelValues...), formatValue(upper)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, le, s.counts[i])
+		}
+		le := formatLabels(names, append(append([]string(nil), s.labelValues...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, le, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
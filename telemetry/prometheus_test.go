@@ -0,0 +1,67 @@
+package telemetry_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+func TestPrometheusExposition(t *testing.T) {
+	p := telemetry.NewPrometheus()
+	p.RequestHandled("/webhook", http.StatusAccepted, 20*time.Millisecond)
+	p.WebhookDispatched("orca:stage:complete", 1)
+	p.WebhookDispatched("orca:stage:complete", 1)
+	p.HandlerCompleted("orca:stage:complete", "DatadogEventHandler", 30*time.Millisecond, nil)
+	p.HandlerCompleted("orca:stage:complete", "DatadogEventHandler", 3*time.Second, errors.New("nope"))
+	p.DatadogAPICall("events", time.Second, errors.New("nope"))
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE spinnaker_bridge_http_requests_total counter",
+		`spinnaker_bridge_http_requests_total{path="/webhook",code="202"} 1`,
+		"spinnaker_bridge_webhook_decode_failures_total 0",
+		`spinnaker_bridge_dispatches_total{hook_type="orca:stage:complete"} 2`,
+		`spinnaker_bridge_handler_results_total{hook_type="orca:stage:complete",handler="DatadogEventHandler",outcome="success"} 1`,
+		`spinnaker_bridge_handler_results_total{hook_type="orca:stage:complete",handler="DatadogEventHandler",outcome="error"} 1`,
+		"# TYPE spinnaker_bridge_handler_duration_seconds histogram",
+		`spinnaker_bridge_handler_duration_seconds_bucket{hook_type="orca:stage:complete",handler="DatadogEventHandler",le="0.05"} 1`,
+		`spinnaker_bridge_handler_duration_seconds_bucket{hook_type="orca:stage:complete",handler="DatadogEventHandler",le="+Inf"} 2`,
+		`spinnaker_bridge_handler_duration_seconds_sum{hook_type="orca:stage:complete",handler="DatadogEventHandler"} 3.03`,
+		`spinnaker_bridge_handler_duration_seconds_count{hook_type="orca:stage:complete",handler="DatadogEventHandler"} 2`,
+		`spinnaker_bridge_datadog_api_calls_total{endpoint="events",outcome="error"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+}
+
+func TestPrometheusEscapesLabelValues(t *testing.T) {
+	p := telemetry.NewPrometheus()
+	p.HandlerPanicked("orca:stage:complete", "bad\"handler\\name\n")
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `spinnaker_bridge_handler_panics_total{hook_type="orca:stage:complete",handler="bad\"handler\\name\n"} 1`)
+}
+
+func TestPrometheusBucketsUnknownHookTypes(t *testing.T) {
+	p := telemetry.NewPrometheus()
+	p.WebhookDispatched("made:up:1", 1)
+	p.WebhookDispatched("made:up:2", 1)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `spinnaker_bridge_dispatches_total{hook_type="other"} 2`+"\n")
+	assert.NotContains(t, body, "made:up")
+}
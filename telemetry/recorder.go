@@ -0,0 +1,112 @@
+// Package telemetry contains the measurements the bridge takes about itself
+// and the backends they can be exported to.
+package telemetry
+
+import "time"
+
+// Recorder receives measurements about the bridge itself as webhooks flow
+// through the server, the dispatcher and the handlers. Implementations decide
+// how those measurements are named and exported.
+type Recorder interface {
+	// RequestHandled is called for every HTTP request the server answers
+	RequestHandled(path string, code int, d time.Duration)
+	// WebhookDecodeFailed is called when a webhook body isn't valid JSON
+	WebhookDecodeFailed()
+	// WebhookTimedOut is called when the server gives up waiting for the
+	// handlers of a webhook
+	WebhookTimedOut()
+	// WebhookDispatched is called once per webhook with the amount of handlers
+	// it was dispatched to
+	WebhookDispatched(hookType string, handlers int)
+	// WebhookDuplicate is called instead of WebhookDispatched when a webhook
+	// is dropped because it was already dispatched
+	WebhookDuplicate(hookType string)
+	// HandlerCompleted is called when a handler returns
+	HandlerCompleted(hookType, handler string, d time.Duration, err error)
+	// HandlerPanicked is called when a handler panics, before HandlerCompleted
+	HandlerPanicked(hookType, handler string)
+	// HandlerAbandoned is called when a handler returns because its context
+	// is done while work it started in the background, such as a call that
+	// can't be cancelled, is still running
+	HandlerAbandoned(hookType, handler string)
+	// MetricTagsCollapsed is called when a metric tag policy collapses a new
+	// distinct value of a tag key of a metric into "other"
+	MetricTagsCollapsed(metric, tagKey string)
+	// DatadogAPICall is called after every call to the Datadog API
+	DatadogAPICall(endpoint string, d time.Duration, err error)
+	// HandlersInFlight is called with the amount of handlers running whenever
+	// a handler starts or finishes
+	HandlersInFlight(n int)
+}
+
+// Nop is a recorder that discards every measurement
+type Nop struct{}
+
+var _ Recorder = Nop{}
+
+// RequestHandled implements Recorder
+func (Nop) RequestHandled(string, int, time.Duration) {}
+
+// WebhookDecodeFailed implements Recorder
+func (Nop) WebhookDecodeFailed() {}
+
+// WebhookTimedOut implements Recorder
+func (Nop) WebhookTimedOut() {}
+
+// WebhookDispatched implements Recorder
+func (Nop) WebhookDispatched(string, int) {}
+
+// WebhookDuplicate implements Recorder
+func (Nop) WebhookDuplicate(string) {}
+
+// HandlerCompleted implements Recorder
+func (Nop) HandlerCompleted(string, string, time.Duration, error) {}
+
+// HandlerPanicked implements Recorder
+func (Nop) HandlerPanicked(string, string) {}
+
+// HandlerAbandoned implements Recorder
+func (Nop) HandlerAbandoned(string, string) {}
+
+// MetricTagsCollapsed implements Recorder
+func (Nop) MetricTagsCollapsed(string, string) {}
+
+// DatadogAPICall implements Recorder
+func (Nop) DatadogAPICall(string, time.Duration, error) {}
+
+// HandlersInFlight implements Recorder
+func (Nop) HandlersInFlight(int) {}
+
+// OtherHookType replaces the hook type of webhooks whose type isn't one Orca
+// sends. Hook types come from the webhook body, so without it anyone who can
+// post to the bridge could create an unbounded number of series
+const OtherHookType = "other"
+
+// knownHookTypes are the hook types Orca sends
+var knownHookTypes = func() map[string]bool {
+	known := make(map[string]bool)
+	for _, kind := range []string{"pipeline", "stage", "task"} {
+		for _, status := range []string{"starting", "complete", "failed"} {
+			known["orca:"+kind+":"+status] = true
+		}
+	}
+	return known
+}()
+
+// hookTypeLabel returns the hook type to record for the given hook type
+func hookTypeLabel(hookType string) string {
+	if knownHookTypes[hookType] {
+		return hookType
+	}
+
+	return OtherHookType
+}
+
+// outcome returns the label used for the result of an operation
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
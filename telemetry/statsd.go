@@ -0,0 +1,112 @@
+package telemetry
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultStatsdNamespace prefixes every metric sent by the Statsd recorder
+const DefaultStatsdNamespace = "spinnaker_bridge."
+
+// StatsdClient is the subset of the DogStatsD client used by the Statsd recorder
+type StatsdClient interface {
+	Incr(name string, tags []string, rate float64) error
+	Timing(name string, value time.Duration, tags []string, rate float64) error
+	Gauge(name string, value float64, tags []string, rate float64) error
+}
+
+// Statsd is a recorder that reports the health of the bridge to DogStatsD. It
+// prefixes its metrics with its own namespace so it can share a client with
+// the metrics sent for Spinnaker events.
+type Statsd struct {
+	client    StatsdClient
+	namespace string
+}
+
+var _ Recorder = (*Statsd)(nil)
+
+// NewStatsd initializes a recorder that sends metrics prefixed with the given
+// namespace (DefaultStatsdNamespace when empty) through the given client
+func NewStatsd(client StatsdClient, namespace string) *Statsd {
+	if namespace == "" {
+		namespace = DefaultStatsdNamespace
+	}
+
+	return &Statsd{client: client, namespace: namespace}
+}
+
+// RequestHandled implements Recorder
+func (s *Statsd) RequestHandled(path string, code int, d time.Duration) {
+	tags := []string{"path:" + path, "status_code:" + strconv.Itoa(code)}
+	s.check(s.client.Incr(s.namespace+"http.requests", tags, 1))
+	s.check(s.client.Timing(s.namespace+"http.request.duration", d, tags, 1))
+}
+
+// WebhookDecodeFailed implements Recorder
+func (s *Statsd) WebhookDecodeFailed() {
+	s.check(s.client.Incr(s.namespace+"webhooks.decode_errors", nil, 1))
+}
+
+// WebhookTimedOut implements Recorder
+func (s *Statsd) WebhookTimedOut() {
+	s.check(s.client.Incr(s.namespace+"webhooks.timeouts", nil, 1))
+}
+
+// WebhookDispatched implements Recorder
+func (s *Statsd) WebhookDispatched(hookType string, handlers int) {
+	s.check(s.client.Incr(s.namespace+"webhooks.received", []string{"hook_type:" + hookTypeLabel(hookType)}, 1))
+}
+
+// WebhookDuplicate implements Recorder
+func (s *Statsd) WebhookDuplicate(hookType string) {
+	s.check(s.client.Incr(s.namespace+"webhooks.duplicates", []string{"hook_type:" + hookTypeLabel(hookType)}, 1))
+}
+
+// HandlerCompleted implements Recorder
+func (s *Statsd) HandlerCompleted(hookType, handler string, d time.Duration, err error) {
+	tags := []string{"hook_type:" + hookTypeLabel(hookType), "handler:" + handler}
+	s.check(s.client.Timing(s.namespace+"handler.duration", d, tags, 1))
+	if err != nil {
+		s.check(s.client.Incr(s.namespace+"handler.errors", tags, 1))
+	}
+}
+
+// HandlerPanicked implements Recorder
+func (s *Statsd) HandlerPanicked(hookType, handler string) {
+	tags := []string{"hook_type:" + hookTypeLabel(hookType), "handler:" + handler}
+	s.check(s.client.Incr(s.namespace+"handler.panics", tags, 1))
+}
+
+// HandlerAbandoned implements Recorder
+func (s *Statsd) HandlerAbandoned(hookType, handler string) {
+	tags := []string{"hook_type:" + hookTypeLabel(hookType), "handler:" + handler}
+	s.check(s.client.Incr(s.namespace+"handler.abandoned", tags, 1))
+}
+
+// MetricTagsCollapsed implements Recorder
+func (s *Statsd) MetricTagsCollapsed(metric, tagKey string) {
+	tags := []string{"metric:" + metric, "tag_key:" + tagKey}
+	s.check(s.client.Incr(s.namespace+"metric_tags.collapsed", tags, 1))
+}
+
+// DatadogAPICall implements Recorder
+func (s *Statsd) DatadogAPICall(endpoint string, d time.Duration, err error) {
+	tags := []string{"endpoint:" + endpoint}
+	s.check(s.client.Timing(s.namespace+"datadog.api.duration", d, tags, 1))
+	if err != nil {
+		s.check(s.client.Incr(s.namespace+"datadog.api.errors", tags, 1))
+	}
+}
+
+// HandlersInFlight implements Recorder
+func (s *Statsd) HandlersInFlight(n int) {
+	s.check(s.client.Gauge(s.namespace+"queue.depth", float64(n), nil, 1))
+}
+
+func (s *Statsd) check(err error) {
+	if err != nil {
+		logrus.WithError(err).Debug("could not send self-telemetry to dogstatsd")
+	}
+}
@@ -0,0 +1,60 @@
+package telemetry_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/spinnaker-datadog-bridge/telemetry"
+)
+
+type fakeStatsd struct {
+	sent []string
+}
+
+func (f *fakeStatsd) record(kind, name string, value interface{}, tags []string) error {
+	f.sent = append(f.sent, fmt.Sprintf("%s %s %v %v", kind, name, value, tags))
+	return nil
+}
+
+func (f *fakeStatsd) Incr(name string, tags []string, rate float64) error {
+	return f.record("incr", name, 1, tags)
+}
+
+func (f *fakeStatsd) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return f.record("timing", name, value, tags)
+}
+
+func (f *fakeStatsd) Gauge(name string, value float64, tags []string, rate float64) error {
+	return f.record("gauge", name, value, tags)
+}
+
+func TestStatsdRecorder(t *testing.T) {
+	client := &fakeStatsd{}
+	r := telemetry.NewStatsd(client, "")
+
+	r.WebhookDispatched("orca:stage:complete", 1)
+	r.WebhookDuplicate("orca:stage:complete")
+	r.HandlersInFlight(1)
+	r.HandlerCompleted("orca:stage:complete", "DatadogEventHandler", time.Second, errors.New("nope"))
+	r.DatadogAPICall("events", time.Second, nil)
+
+	assert.Equal(t, []string{
+		"incr spinnaker_bridge.webhooks.received 1 [hook_type:orca:stage:complete]",
+		"incr spinnaker_bridge.webhooks.duplicates 1 [hook_type:orca:stage:complete]",
+		"gauge spinnaker_bridge.queue.depth 1 []",
+		"timing spinnaker_bridge.handler.duration 1s [hook_type:orca:stage:complete handler:DatadogEventHandler]",
+		"incr spinnaker_bridge.handler.errors 1 [hook_type:orca:stage:complete handler:DatadogEventHandler]",
+		"timing spinnaker_bridge.datadog.api.duration 1s [endpoint:events]",
+	}, client.sent)
+}
+
+func TestStatsdRecorderNamespace(t *testing.T) {
+	client := &fakeStatsd{}
+	telemetry.NewStatsd(client, "bridge.").WebhookTimedOut()
+
+	assert.Equal(t, []string{"incr bridge.webhooks.timeouts 1 []"}, client.sent)
+}